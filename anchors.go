@@ -0,0 +1,164 @@
+/*******************************************************************************
+*
+* Copyright 2018 Stefan Majewsky <majewsky@gmx.net>
+*
+* This program is free software: you can redistribute it and/or modify it under
+* the terms of the GNU General Public License as published by the Free Software
+* Foundation, either version 3 of the License, or (at your option) any later
+* version.
+*
+* This program is distributed in the hope that it will be useful, but WITHOUT ANY
+* WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR
+* A PARTICULAR PURPOSE. See the GNU General Public License for more details.
+*
+* You should have received a copy of the GNU General Public License along with
+* this program. If not, see <http://www.gnu.org/licenses/>.
+*
+*******************************************************************************/
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+//AnchorManifestFileName is the name of the file in the output directory that
+//records the heading IDs of the previous build.
+const AnchorManifestFileName = "anchors.json"
+
+//AnchorManifest records the heading IDs on each page, so that the next build
+//can detect headings whose ID changed (usually because the sections were
+//renumbered) and keep the old ID working as an alias. The key is the URL path
+//of the page as given by its source file, so drafts keep their aliases when
+//they are published below DraftsURLPath.
+type AnchorManifest map[string][]AnchorManifestEntry
+
+//AnchorManifestEntry describes a single heading in the AnchorManifest.
+type AnchorManifestEntry struct {
+	ID      string   `json:"id"`
+	Key     string   `json:"key"` //identifies the heading independently of its section number
+	Aliases []string `json:"aliases,omitempty"`
+}
+
+//LoadAnchorManifest reads the anchor manifest from the given output directory.
+//If there is none yet, an empty manifest is returned.
+func LoadAnchorManifest(outputDir string) (AnchorManifest, error) {
+	path := filepath.Join(outputDir, AnchorManifestFileName)
+	buf, err := ioutil.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return AnchorManifest{}, nil
+		}
+		return nil, err
+	}
+	var m AnchorManifest
+	err = json.Unmarshal(buf, &m)
+	if err != nil {
+		return nil, fmt.Errorf("read %s: %s", path, err.Error())
+	}
+	return m, nil
+}
+
+//NewAnchorManifest records the headings of the given pages.
+func NewAnchorManifest(pages []*Page) AnchorManifest {
+	m := make(AnchorManifest)
+	for _, page := range pages {
+		for _, e := range page.toc {
+			m[page.sourceURLPath] = append(m[page.sourceURLPath], AnchorManifestEntry{
+				ID:      e.ID,
+				Key:     anchorKey(e.Caption),
+				Aliases: e.Aliases,
+			})
+		}
+	}
+	return m
+}
+
+//WriteTo writes this manifest into the given output directory.
+func (m AnchorManifest) WriteTo(out *OutputDir) error {
+	buf, err := json.Marshal(m)
+	if err != nil {
+		return err
+	}
+	return out.WriteFile(AnchorManifestFileName, append(buf, '\n'))
+}
+
+//Identifies a heading by its caption without the section number, e.g.
+//"3.2. Message format" and "3.3. Message format" have the same key.
+func anchorKey(caption string) string {
+	caption = strings.TrimSpace(caption)
+	return idFromCaption(sectionNumberRx.ReplaceAllString(caption, ""))
+}
+
+//AddAnchorAliases fills TOCEntry.Aliases for the headings of the page at
+//urlPath (as given by the source file, see AnchorManifest). Aliases are taken
+//from the "anchor_aliases" front matter (key = alias, value = ID of heading)
+//and from the previous build's manifest: When a heading has the same caption
+//as before, but a different ID, the old ID becomes an alias.
+func AddAnchorAliases(sourcePath, urlPath string, toc []TOCEntry, explicitAliases map[string]string, previous AnchorManifest) error {
+	isCurrentID := make(map[string]bool, len(toc))
+	for _, e := range toc {
+		isCurrentID[e.ID] = true
+	}
+	isAliasUsed := make(map[string]bool)
+	addAlias := func(idx int, alias string) {
+		if alias == "" || isCurrentID[alias] || isAliasUsed[alias] {
+			return
+		}
+		isAliasUsed[alias] = true
+		toc[idx].Aliases = append(toc[idx].Aliases, alias)
+	}
+
+	//explicit aliases (sorted for deterministic results)
+	aliases := make([]string, 0, len(explicitAliases))
+	for alias := range explicitAliases {
+		aliases = append(aliases, alias)
+	}
+	sort.Strings(aliases)
+	for _, alias := range aliases {
+		id := explicitAliases[alias]
+		if isCurrentID[alias] {
+			return fmt.Errorf("%s: anchor_aliases: %q is the ID of an existing heading", sourcePath, alias)
+		}
+		found := false
+		for idx, e := range toc {
+			if e.ID == id {
+				addAlias(idx, alias)
+				found = true
+				break
+			}
+		}
+		if !found {
+			return fmt.Errorf("%s: anchor_aliases: no heading with ID %q", sourcePath, id)
+		}
+	}
+
+	//aliases from the previous build (when multiple headings have the same
+	//key, they are matched in order)
+	previousByKey := make(map[string][]AnchorManifestEntry)
+	for _, e := range previous[urlPath] {
+		previousByKey[e.Key] = append(previousByKey[e.Key], e)
+	}
+	keyCount := make(map[string]int)
+	for idx, e := range toc {
+		key := anchorKey(e.Caption)
+		n := keyCount[key]
+		keyCount[key]++
+		if n >= len(previousByKey[key]) {
+			continue
+		}
+		prev := previousByKey[key][n]
+		addAlias(idx, prev.ID)
+		for _, alias := range prev.Aliases {
+			addAlias(idx, alias)
+		}
+	}
+
+	return nil
+}
@@ -24,25 +24,38 @@ import (
 	"path/filepath"
 )
 
-//CopyAssets copies all files from the input to the output directory.
-func CopyAssets(inputDir, outputDir string) error {
-	return filepath.Walk(inputDir, func(path string, fi os.FileInfo, err error) error {
+//ListAssets returns the paths of all files in the input directory, relative
+//to it.
+func ListAssets(inputDir string) ([]string, error) {
+	var result []string
+	err := filepath.Walk(inputDir, func(path string, fi os.FileInfo, err error) error {
 		if err != nil || fi.Mode().IsDir() {
 			return err
 		}
-
 		relPath, _ := filepath.Rel(inputDir, path)
-		targetPath := filepath.Join(outputDir, relPath)
+		result = append(result, relPath)
+		return nil
+	})
+	return result, err
+}
 
-		err = os.MkdirAll(filepath.Dir(targetPath), 0777)
+//CopyAssets copies all files from the input directory to the given
+//subdirectory of the output directory.
+func CopyAssets(inputDir string, out *OutputDir, relOutputDir string) error {
+	relPaths, err := ListAssets(inputDir)
+	if err != nil {
+		return err
+	}
+	for _, relPath := range relPaths {
+		//copy files in such a way that symlinks are converted to regular files at the target
+		buf, err := ioutil.ReadFile(filepath.Join(inputDir, relPath))
 		if err != nil {
 			return err
 		}
-		//copy files in such a way that symlinks are converted to regular files at the target
-		buf, err := ioutil.ReadFile(path)
+		err = out.WriteFile(filepath.Join(relOutputDir, relPath), buf)
 		if err != nil {
 			return err
 		}
-		return ioutil.WriteFile(targetPath, buf, 0666)
-	})
+	}
+	return nil
 }
@@ -0,0 +1,481 @@
+/*******************************************************************************
+*
+* Copyright 2018 Stefan Majewsky <majewsky@gmx.net>
+*
+* This program is free software: you can redistribute it and/or modify it under
+* the terms of the GNU General Public License as published by the Free Software
+* Foundation, either version 3 of the License, or (at your option) any later
+* version.
+*
+* This program is distributed in the hope that it will be useful, but WITHOUT ANY
+* WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR
+* A PARTICULAR PURPOSE. See the GNU General Public License for more details.
+*
+* You should have received a copy of the GNU General Public License along with
+* this program. If not, see <http://www.gnu.org/licenses/>.
+*
+*******************************************************************************/
+
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+//Build modes, see Config.BuildMode.
+const (
+	//drafts are not published at all
+	BuildModeProduction = "production"
+	//drafts are published like all other pages
+	BuildModePreview = "preview"
+	//drafts are published below DraftsURLPath
+	BuildModeSplit = "split"
+)
+
+//DraftsURLPath is where draft pages are published in BuildModeSplit, e.g.
+//"/drafts/std/core/1.1" instead of "/std/core/1.1".
+const DraftsURLPath = "/drafts"
+
+//Builder holds the state of a build, so that it can be updated incrementally
+//when only some of the input files change.
+type Builder struct {
+	Config    Config
+	OutputDir string
+	TikzCache *TikzCache //may be nil
+	Jobs      int        //how many pages to render at once
+	//if set, the output directory is assembled in a staging directory next
+	//to it, which then replaces the output directory at once
+	AtomicPublish bool
+	//if set, broken links fail the build instead of just being reported
+	StrictLinks bool
+
+	sourceFiles []SourceFile
+	pages       map[string]*Page //key = SourceFile.FilesystemPath
+	//the heading IDs from the output directory at the time of the first
+	//Build(); all builds compare against these, so that a heading that is
+	//changed and changed back in watch mode does not leave an alias behind
+	previousAnchors AnchorManifest
+	//the heading IDs recorded by the last full Build(), which incremental
+	//rebuilds write unchanged
+	anchors AnchorManifest
+	//set when the last build failed, so we don't know which state we're in
+	needsFullBuild bool
+}
+
+//NewBuilder initializes a Builder. No work is done until Build() is called.
+func NewBuilder(cfg Config, outputDir string) *Builder {
+	return &Builder{
+		Config:         cfg,
+		OutputDir:      outputDir,
+		Jobs:           1,
+		needsFullBuild: true,
+	}
+}
+
+func (b *Builder) specDir() string       { return b.Config.InputPath(b.Config.SpecDir) }
+func (b *Builder) pagesDir() string      { return b.Config.InputPath(b.Config.PagesDir) }
+func (b *Builder) templatePath() string  { return b.Config.InputPath(b.Config.PageTemplate) }
+func (b *Builder) templateDir() string   { return filepath.Dir(b.templatePath()) }
+func (b *Builder) staticDir() string     { return b.Config.InputPath(b.Config.StaticDir) }
+func (b *Builder) redirectsPath() string { return b.Config.InputPath(b.Config.RedirectsFile) }
+
+//Build renders all pages and copies all static assets into the output
+//directory.
+func (b *Builder) Build() error {
+	b.needsFullBuild = true
+	b.TikzCache.Reset()
+
+	//load templates
+	err := initPageTemplates(b.templatePath())
+	if err != nil {
+		return err
+	}
+
+	//render source files
+	if b.previousAnchors == nil {
+		b.previousAnchors, err = LoadAnchorManifest(b.OutputDir)
+		if err != nil {
+			return err
+		}
+	}
+	b.sourceFiles, err = FindSourceFiles(b.Config)
+	if err != nil {
+		return err
+	}
+	b.pages = make(map[string]*Page, len(b.sourceFiles))
+	err = b.renderAll(b.sourceFiles)
+	if err != nil {
+		return err
+	}
+
+	err = b.publish(true)
+	if err != nil {
+		return err
+	}
+
+	//all pages were rendered, so the TikZ cache knows which entries are still needed
+	err = b.TikzCache.EvictUnused()
+	if err != nil {
+		return err
+	}
+	b.TikzCache.ReportStats()
+
+	b.needsFullBuild = false
+	return nil
+}
+
+//Rebuild updates the output directory after the given input files have been
+//added, changed or removed. Only the affected pages are rendered again.
+func (b *Builder) Rebuild(changedPaths []string) error {
+	if b.needsFullBuild {
+		return b.Build()
+	}
+	b.needsFullBuild = true
+
+	//sort changes into categories (changed static assets do not need to be
+	//tracked since publish() copies all of them anyway)
+	var (
+		templateChanged bool
+		sourcesChanged  = make(map[string]bool)
+	)
+	for _, path := range changedPaths {
+		switch {
+		case path == b.templatePath() || (filepath.Dir(path) == b.templateDir() && strings.HasSuffix(path, templateSuffix)):
+			templateChanged = true
+		case isBelow(path, b.specDir()) || isBelow(path, b.pagesDir()):
+			if strings.HasSuffix(path, ".md") {
+				sourcesChanged[path] = true
+			}
+		}
+	}
+
+	if templateChanged {
+		err := initPageTemplates(b.templatePath())
+		if err != nil {
+			return err
+		}
+	}
+
+	//re-render changed source files (this also picks up added and removed files)
+	if len(sourcesChanged) > 0 {
+		sourceFiles, err := FindSourceFiles(b.Config)
+		if err != nil {
+			return err
+		}
+		isPresent := make(map[string]bool, len(sourceFiles))
+		var rerendered []SourceFile
+		for _, sourceFile := range sourceFiles {
+			isPresent[sourceFile.FilesystemPath] = true
+			if sourcesChanged[sourceFile.FilesystemPath] {
+				rerendered = append(rerendered, sourceFile)
+			}
+		}
+		err = b.renderAll(rerendered)
+		if err != nil {
+			return err
+		}
+		for path := range b.pages {
+			if !isPresent[path] {
+				delete(b.pages, path)
+			}
+		}
+		b.sourceFiles = sourceFiles
+	}
+
+	//writing all pages is cheap compared to rendering them, and ensures that
+	//the output directory is consistent with the new set of pages
+	err := b.publish(false)
+	if err != nil {
+		return err
+	}
+
+	b.needsFullBuild = false
+	return nil
+}
+
+//Writes all rendered pages and all static assets into the output directory,
+//and removes files that were left over from previous builds. The anchor
+//manifest is only updated on full builds.
+func (b *Builder) publish(isFullBuild bool) (returnErr error) {
+	//the navigation tree is rebuilt every time since page weights might have
+	//changed, not only the set of pages
+	pages := b.publishedPages()
+	statusPage, err := GenerateStatusPage(pages, b.Config)
+	if err != nil {
+		return err
+	}
+	if statusPage != nil {
+		pages = append(pages, statusPage)
+	}
+	pages = append(pages, GenerateDiffPages(pages, b.Config)...)
+	navTree := NewNavigationTree(pages)
+	if b.Config.IndexPages == IndexPagesGenerate {
+		listingPages, err := GenerateListingPages(navTree, pages, b.Config)
+		if err != nil {
+			return err
+		}
+		pages = append(pages, listingPages...)
+	}
+	var errs ErrorList
+	for _, page := range pages {
+		page.AddNavigation(navTree)
+		err := page.ResolveStatusLinks(navTree)
+		if err != nil {
+			errs = append(errs, err)
+		}
+	}
+	if len(errs) > 0 {
+		return errs
+	}
+	latestVersions := AddVersionLinks(pages, navTree, b.Config)
+
+	//collect redirects from aliases and the redirects file; also, make
+	//"/std/core/latest" redirect to the latest version of "/std/core" (unless
+	//that path is taken already)
+	fileRedirects, err := LoadRedirectsFile(b.redirectsPath())
+	if err != nil {
+		return err
+	}
+	redirects, err := CollectRedirects(pages, fileRedirects)
+	if err != nil {
+		return err
+	}
+	isTaken := make(map[string]bool)
+	for _, r := range redirects {
+		isTaken[r.From] = true
+	}
+	for module, latestPath := range latestVersions {
+		latestAlias := path.Join(module, "latest")
+		node := ntLocate(navTree, latestAlias, false)
+		if isTaken[latestAlias] || (node != nil && node.Exists) {
+			continue
+		}
+		//not permanent since the target changes when a new version is released
+		redirects = append(redirects, Redirect{From: latestAlias, To: latestPath, Permanent: false})
+	}
+
+	//now that we know all pages and files, we can check links between them
+	//before anything is written
+	files, err := b.outputFiles(pages, redirects)
+	if err != nil {
+		return err
+	}
+	brokenLinks := CheckLinks(pages, files)
+	if b.StrictLinks && len(brokenLinks) > 0 {
+		errs := make(ErrorList, len(brokenLinks))
+		for idx, link := range brokenLinks {
+			errs[idx] = link
+		}
+		return errs
+	}
+	for _, link := range brokenLinks {
+		fmt.Fprintln(os.Stderr, "WARNING: "+link.Error())
+	}
+
+	targetDir := b.OutputDir
+	if b.AtomicPublish {
+		//the staging directory must be next to the output directory, so that
+		//it can be renamed into place
+		outputDir := filepath.Clean(b.OutputDir)
+		err := os.MkdirAll(outputDir, 0777)
+		if err != nil {
+			return err
+		}
+		fi, err := os.Stat(outputDir)
+		if err != nil {
+			return err
+		}
+		targetDir, err = ioutil.TempDir(filepath.Dir(outputDir), "."+filepath.Base(outputDir)+".staging-")
+		if err != nil {
+			return err
+		}
+		defer func() {
+			if returnErr != nil {
+				os.RemoveAll(targetDir)
+			}
+		}()
+		//TempDir() creates the directory with mode 0700, but the web server
+		//might need to read it, so use the same permissions as the existing
+		//output directory (or the default permissions if it was just created)
+		err = os.Chmod(targetDir, fi.Mode().Perm())
+		if err != nil {
+			return err
+		}
+	}
+
+	out, err := NewOutputDir(targetDir)
+	if err != nil {
+		return err
+	}
+	out.ClaimWithoutManifest = b.isGeneratedFile
+	if !b.AtomicPublish {
+		//files written before the build failed must still be recorded in the
+		//manifest, otherwise they would never be cleaned up
+		defer func() {
+			if returnErr != nil {
+				err := out.Abort()
+				if err != nil {
+					returnErr = ErrorList{returnErr, err}
+				}
+			}
+		}()
+	}
+
+	//write resulting HTML pages to output directory
+	err = forEachParallel(b.Jobs, len(pages), func(idx int) error {
+		return pages[idx].WriteTo(out)
+	})
+	if err != nil {
+		return err
+	}
+	err = WriteRedirects(redirects, b.Config.RedirectFormatList(), out)
+	if err != nil {
+		return err
+	}
+
+	//copy static assets
+	err = CopyAssets(b.staticDir(), out, b.Config.StaticOutputDir)
+	if err != nil {
+		return err
+	}
+
+	//write site-wide files
+	err = WriteSitemap(pages, b.Config, out)
+	if err != nil {
+		return err
+	}
+	err = WriteSearchIndex(pages, out)
+	if err != nil {
+		return err
+	}
+	anchors := b.anchors
+	if isFullBuild {
+		anchors = NewAnchorManifest(pages)
+	}
+	err = anchors.WriteTo(out)
+	if err != nil {
+		return err
+	}
+
+	err = out.Finalize()
+	if err != nil {
+		return err
+	}
+	if b.AtomicPublish {
+		err = swapOutputDir(targetDir, b.OutputDir)
+		if err != nil {
+			return err
+		}
+	}
+
+	b.anchors = anchors
+	return nil
+}
+
+//Returns the paths (relative to the output directory) of all files that
+//publish() writes for the given pages and redirects, so that links can be
+//checked before anything is written.
+func (b *Builder) outputFiles(pages []*Page, redirects []Redirect) (map[string]bool, error) {
+	files := make(map[string]bool)
+	add := func(relPath string) {
+		files[normalizeOutputPath(relPath)] = true
+	}
+
+	for _, page := range pages {
+		add(path.Join(page.Path, "index.html"))
+		for _, asset := range page.Assets {
+			add(asset.Path)
+		}
+	}
+	//links to redirected paths are fine no matter how the redirect is served
+	for _, r := range redirects {
+		add(path.Join(r.From, "index.html"))
+	}
+	for _, format := range b.Config.RedirectFormatList() {
+		switch format {
+		case RedirectFormatNetlify:
+			add(NetlifyRedirectsFileName)
+		case RedirectFormatNginx:
+			add(NginxRedirectsFileName)
+			add(NginxTemporaryRedirectsFileName)
+		}
+	}
+
+	assetPaths, err := ListAssets(b.staticDir())
+	if err != nil {
+		return nil, err
+	}
+	for _, relPath := range assetPaths {
+		add(filepath.Join(b.Config.StaticOutputDir, relPath))
+	}
+
+	for _, fileName := range []string{SitemapFileName, RobotsTxtFileName, SearchIndexFileName, SearchWidgetFileName, AnchorManifestFileName} {
+		add(fileName)
+	}
+	return files, nil
+}
+
+//Recognizes files that earlier versions of this program wrote into the output
+//directory before there was a manifest: pages and compiled TikZ pictures.
+func (b *Builder) isGeneratedFile(relPath string) bool {
+	if path.Base(relPath) == "index.html" {
+		return true
+	}
+	svgDir := path.Clean(filepath.ToSlash(b.Config.SVGOutputDir))
+	return path.Dir(relPath) == svgDir && path.Ext(relPath) == ".svg"
+}
+
+//Renders the given source files into b.pages. If some of them fail to render,
+//the others are still stored.
+func (b *Builder) renderAll(sourceFiles []SourceFile) error {
+	pages := make([]*Page, len(sourceFiles))
+	err := forEachParallel(b.Jobs, len(sourceFiles), func(idx int) error {
+		page, err := sourceFiles[idx].Render(b.Config, b.TikzCache, b.previousAnchors)
+		if err != nil {
+			return err
+		}
+		pages[idx] = &page
+		return nil
+	})
+
+	//b.pages must not be written to concurrently, so this happens afterwards
+	for idx, sourceFile := range sourceFiles {
+		if pages[idx] != nil {
+			b.pages[sourceFile.FilesystemPath] = pages[idx]
+		}
+	}
+	return err
+}
+
+//Returns the pages that are published in the configured build mode, in a
+//deterministic order.
+func (b *Builder) publishedPages() []*Page {
+	result := make([]*Page, 0, len(b.sourceFiles))
+	for _, sourceFile := range b.sourceFiles {
+		page := b.pages[sourceFile.FilesystemPath]
+		if page.IsDraft {
+			switch b.Config.BuildMode {
+			case BuildModeProduction:
+				continue
+			case BuildModeSplit:
+				//copy the page since b.pages must retain the original path for the next publish()
+				draft := *page
+				draft.Path = path.Join(DraftsURLPath, page.Path)
+				page = &draft
+			}
+		}
+		result = append(result, page)
+	}
+	return result
+}
+
+//Returns whether `path` is `dir` or somewhere below it.
+func isBelow(path, dir string) bool {
+	relPath, err := filepath.Rel(dir, path)
+	return err == nil && relPath != ".." && !strings.HasPrefix(relPath, "../")
+}
@@ -0,0 +1,338 @@
+/*******************************************************************************
+*
+* Copyright 2018 Stefan Majewsky <majewsky@gmx.net>
+*
+* This program is free software: you can redistribute it and/or modify it under
+* the terms of the GNU General Public License as published by the Free Software
+* Foundation, either version 3 of the License, or (at your option) any later
+* version.
+*
+* This program is distributed in the hope that it will be useful, but WITHOUT ANY
+* WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR
+* A PARTICULAR PURPOSE. See the GNU General Public License for more details.
+*
+* You should have received a copy of the GNU General Public License along with
+* this program. If not, see <http://www.gnu.org/licenses/>.
+*
+*******************************************************************************/
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+//DefaultConfigPath is where the config file is expected, relative to the input directory.
+const DefaultConfigPath = "website/config.json"
+
+//Config describes the layout of the input repository and of the generated
+//website. All directories are relative to the input directory (for inputs) or
+//to the output directory (for outputs).
+//
+//When adding fields, also add them to fields() and to the README.
+type Config struct {
+	SpecDir         string `json:"spec_dir"`
+	PagesDir        string `json:"pages_dir"`
+	PageTemplate    string `json:"page_template"`
+	StaticDir       string `json:"static_dir"`
+	SpecURLPrefix   string `json:"spec_url_prefix"`
+	StaticOutputDir string `json:"static_output_dir"`
+	SVGOutputDir    string `json:"svg_output_dir"`
+	BaseURL         string `json:"base_url"`
+	RedirectsFile   string `json:"redirects_file"`
+	RedirectFormats string `json:"redirect_formats"`
+	BuildMode       string `json:"build_mode"`
+	IndexPages      string `json:"index_pages"`
+	IndexTemplate   string `json:"index_template"`
+	TOCMinLevel     int    `json:"toc_min_level"`
+	TOCMaxLevel     int    `json:"toc_max_level"`
+	SectionNumbers  string `json:"section_numbers"`
+	Permalinks      string `json:"permalinks"`
+	PermalinkSymbol string `json:"permalink_symbol"`
+
+	InputDir string `json:"-"`
+}
+
+//DefaultConfig returns the configuration that is used when neither config file
+//nor flags say otherwise. This matches the layout of the VT6 repository.
+func DefaultConfig() Config {
+	return Config{
+		SpecDir:         "spec",
+		PagesDir:        "website/pages",
+		PageTemplate:    "website/templates/page.html.tpl",
+		StaticDir:       "website/static",
+		SpecURLPrefix:   "std",
+		StaticOutputDir: "static",
+		SVGOutputDir:    "svg",
+		BaseURL:         "https://vt6.io",
+		RedirectsFile:   "website/redirects.txt",
+		RedirectFormats: RedirectFormatHTML,
+		BuildMode:       BuildModeProduction,
+		IndexPages:      IndexPagesGenerate,
+		IndexTemplate:   "index",
+		TOCMinLevel:     2,
+		TOCMaxLevel:     6,
+		SectionNumbers:  SectionNumbersManual,
+		Permalinks:      PermalinksHeadings,
+		PermalinkSymbol: "§",
+	}
+}
+
+type configField struct {
+	Key         string
+	Value       interface{} //either *string or *int
+	Validate    func(string) error
+	Description string
+}
+
+//Returns the field's value in the string form that is used by flags.
+func (f configField) String() string {
+	switch value := f.Value.(type) {
+	case *int:
+		return strconv.Itoa(*value)
+	default:
+		return *value.(*string)
+	}
+}
+
+//Sets the field's value from the string form that is used by flags.
+func (f configField) Set(input string) error {
+	switch value := f.Value.(type) {
+	case *int:
+		number, err := strconv.Atoi(input)
+		if err != nil {
+			return fmt.Errorf("invalid config: %s must be an integer, got %q", f.Key, input)
+		}
+		*value = number
+	default:
+		*value.(*string) = input
+	}
+	return nil
+}
+
+//Lists all fields, so that flags can be generated for them.
+func (cfg *Config) fields() []configField {
+	return []configField{
+		{"spec_dir", &cfg.SpecDir, validateRelativePath, "input directory containing the specs"},
+		{"pages_dir", &cfg.PagesDir, validateRelativePath, "input directory containing the other website pages"},
+		{"page_template", &cfg.PageTemplate, validateRelativePath, "template file for HTML pages"},
+		{"static_dir", &cfg.StaticDir, validateRelativePath, "input directory containing static assets"},
+		{"spec_url_prefix", &cfg.SpecURLPrefix, validateRelativePath, "URL path below which the specs are published"},
+		{"static_output_dir", &cfg.StaticOutputDir, validateRelativePath, "output directory for static assets"},
+		{"svg_output_dir", &cfg.SVGOutputDir, validateRelativePath, "output directory for compiled TikZ pictures"},
+		{"base_url", &cfg.BaseURL, validateBaseURL, "URL where the website is published, for absolute URLs in sitemap.xml"},
+		{"redirects_file", &cfg.RedirectsFile, validateRelativePath, "file listing additional redirects (optional)"},
+		{"redirect_formats", &cfg.RedirectFormats, validateListOf(allRedirectFormats...), "comma-separated list of output formats for redirects (\"html\", \"netlify\", \"nginx\")"},
+		{"build_mode", &cfg.BuildMode, validateOneOf(BuildModeProduction, BuildModePreview, BuildModeSplit), "what to do with draft pages: leave them out (\"production\"), publish them like other pages (\"preview\"), or publish them below /drafts (\"split\")"},
+		{"index_pages", &cfg.IndexPages, validateOneOf(IndexPagesGenerate, IndexPagesOmit), "what to do with directories without a page: \"generate\" a listing page or \"omit\" them from breadcrumbs"},
+		{"index_template", &cfg.IndexTemplate, validateTemplateName, "name of the template for generated listing pages (falls back to the default template if it does not exist)"},
+		{"toc_min_level", &cfg.TOCMinLevel, validateHeadingLevel, "lowest heading level (e.g. 2 for <h2>) included in tables of contents"},
+		{"toc_max_level", &cfg.TOCMaxLevel, validateHeadingLevel, "highest heading level included in tables of contents"},
+		{"permalinks", &cfg.Permalinks, validateOneOf(PermalinksNone, PermalinksHeadings, PermalinksAll), "which elements get a link to themselves: \"none\", \"headings\" or \"all\" (headings and paragraphs)"},
+		{"permalink_symbol", &cfg.PermalinkSymbol, validateAny, "link text for permalinks"},
+		{"section_numbers", &cfg.SectionNumbers, validateOneOf(SectionNumbersManual, SectionNumbersAuto), "whether section numbers in headings are checked (\"manual\") or generated (\"auto\")"},
+	}
+}
+
+//ConfigFlags holds the flags that override config file settings.
+type ConfigFlags struct {
+	ConfigPath *string
+	values     map[string]*string
+	flagSet    *flag.FlagSet
+}
+
+//AddConfigFlags adds a flag for each config field to the given FlagSet.
+func AddConfigFlags(fs *flag.FlagSet) ConfigFlags {
+	cf := ConfigFlags{
+		ConfigPath: fs.String("config", "", "path to config file (default: <path-to-vt6-repo>/"+DefaultConfigPath+" if it exists)"),
+		values:     make(map[string]*string),
+		flagSet:    fs,
+	}
+	defaults := DefaultConfig()
+	for _, field := range defaults.fields() {
+		flagName := strings.Replace(field.Key, "_", "-", -1)
+		cf.values[field.Key] = fs.String(flagName, "",
+			fmt.Sprintf("%s (overrides %q in config file; default: %q)", field.Description, field.Key, field.String()),
+		)
+	}
+	return cf
+}
+
+//LoadConfig assembles the effective configuration from the defaults, the
+//config file (if any) and the given flags, in increasing order of precedence.
+func LoadConfig(inputDir string, flags ConfigFlags) (Config, error) {
+	cfg := DefaultConfig()
+	cfg.InputDir = inputDir
+
+	//read config file, if any
+	path := *flags.ConfigPath
+	mustExist := path != ""
+	if path == "" {
+		path = filepath.Join(inputDir, DefaultConfigPath)
+	}
+	buf, err := ioutil.ReadFile(path)
+	switch {
+	case err == nil:
+		dec := json.NewDecoder(bytes.NewReader(buf))
+		dec.DisallowUnknownFields()
+		err := dec.Decode(&cfg)
+		if err != nil {
+			return Config{}, fmt.Errorf("read %s: %s", path, err.Error())
+		}
+		if dec.More() {
+			return Config{}, fmt.Errorf("read %s: unexpected data after config object", path)
+		}
+	case os.IsNotExist(err) && !mustExist:
+		//config file is optional
+	default:
+		return Config{}, err
+	}
+
+	//apply flags that were given explicitly
+	for _, field := range cfg.fields() {
+		value := *flags.values[field.Key]
+		if value != "" {
+			err := field.Set(value)
+			if err != nil {
+				return Config{}, err
+			}
+		}
+	}
+
+	return cfg, cfg.validate()
+}
+
+func (cfg Config) validate() error {
+	var errs ErrorList
+	for _, field := range cfg.fields() {
+		value := field.String()
+		if value == "" {
+			errs = append(errs, fmt.Errorf("invalid config: %s may not be empty", field.Key))
+			continue
+		}
+		err := field.Validate(value)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("invalid config: %s %s, got %q", field.Key, err.Error(), value))
+		}
+	}
+	if len(errs) == 0 {
+		if cfg.TOCMinLevel > cfg.TOCMaxLevel {
+			errs = append(errs, errors.New("invalid config: toc_min_level may not be greater than toc_max_level"))
+		}
+	}
+	if len(errs) > 0 {
+		return errs
+	}
+	return nil
+}
+
+//Permalink modes, see Config.Permalinks.
+const (
+	PermalinksNone     = "none"
+	PermalinksHeadings = "headings"
+	PermalinksAll      = "all"
+)
+
+//PermalinkOptions returns the options for AddTargetsToHeadings() that
+//correspond to Permalinks and PermalinkSymbol.
+func (cfg Config) PermalinkOptions() PermalinkOptions {
+	if cfg.Permalinks == PermalinksNone {
+		return PermalinkOptions{}
+	}
+	return PermalinkOptions{
+		Symbol:     cfg.PermalinkSymbol,
+		Paragraphs: cfg.Permalinks == PermalinksAll,
+	}
+}
+
+//RedirectFormatList returns the parsed value of RedirectFormats.
+func (cfg Config) RedirectFormatList() []string {
+	var result []string
+	for _, item := range strings.Split(cfg.RedirectFormats, ",") {
+		result = append(result, strings.TrimSpace(item))
+	}
+	return result
+}
+
+func validateRelativePath(value string) error {
+	if filepath.IsAbs(value) || strings.HasPrefix(filepath.Clean(value), "..") {
+		return errors.New("must be a relative path inside the repository")
+	}
+	return nil
+}
+
+func validateBaseURL(value string) error {
+	u, err := url.Parse(value)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return errors.New("must be an absolute http:// or https:// URL")
+	}
+	return nil
+}
+
+func validateOneOf(values ...string) func(string) error {
+	return func(value string) error {
+		for _, v := range values {
+			if value == v {
+				return nil
+			}
+		}
+		return fmt.Errorf("must be one of %q", values)
+	}
+}
+
+func validateListOf(values ...string) func(string) error {
+	validateOne := validateOneOf(values...)
+	return func(value string) error {
+		for _, item := range strings.Split(value, ",") {
+			if validateOne(strings.TrimSpace(item)) != nil {
+				return fmt.Errorf("must be a comma-separated list of %q", values)
+			}
+		}
+		return nil
+	}
+}
+
+func validateAny(value string) error {
+	return nil
+}
+
+func validateHeadingLevel(value string) error {
+	level, err := strconv.Atoi(value)
+	if err != nil || level < 1 || level > 6 {
+		return errors.New("must be a heading level between 1 and 6")
+	}
+	return nil
+}
+
+func validateTemplateName(value string) error {
+	if strings.ContainsAny(value, "/\\") || strings.HasSuffix(value, templateSuffix) {
+		return fmt.Errorf("must be a template name without directory or %q suffix", templateSuffix)
+	}
+	return nil
+}
+
+//Print writes the effective configuration to stdout in the same format as the
+//config file.
+func (cfg Config) Print() error {
+	buf, err := json.MarshalIndent(cfg, "", "  ")
+	if err != nil {
+		return err
+	}
+	_, err = os.Stdout.Write(append(buf, '\n'))
+	return err
+}
+
+//InputPath returns the full path for a path relative to the input directory.
+func (cfg Config) InputPath(relPath string) string {
+	return filepath.Join(cfg.InputDir, relPath)
+}
@@ -0,0 +1,314 @@
+/*******************************************************************************
+*
+* Copyright 2018 Stefan Majewsky <majewsky@gmx.net>
+*
+* This program is free software: you can redistribute it and/or modify it under
+* the terms of the GNU General Public License as published by the Free Software
+* Foundation, either version 3 of the License, or (at your option) any later
+* version.
+*
+* This program is distributed in the hope that it will be useful, but WITHOUT ANY
+* WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR
+* A PARTICULAR PURPOSE. See the GNU General Public License for more details.
+*
+* You should have received a copy of the GNU General Public License along with
+* this program. If not, see <http://www.gnu.org/licenses/>.
+*
+*******************************************************************************/
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"html"
+	"html/template"
+	"path"
+	"strings"
+)
+
+//DiffURLElement is appended to the URL path of a version to get the URL path
+//of the page comparing it to the previous version, e.g. "/std/core/1.1/diff".
+const DiffURLElement = "diff"
+
+//How many unchanged lines are shown around each change.
+const diffContextLines = 3
+
+//GenerateDiffPages creates a page for each pair of adjacent versions of a
+//module (see versionedModules) that shows the changes between the Markdown
+//sources of both versions. The page is placed below the newer version, and
+//linked from both versions as Page.DiffToPrevious and Page.DiffToNext.
+func GenerateDiffPages(pages []*Page, cfg Config) []*Page {
+	for _, page := range pages {
+		page.DiffToPrevious = nil
+		page.DiffToNext = nil
+	}
+
+	var result []*Page
+	for _, versions := range versionedModules(pages, cfg) {
+		for idx := 1; idx < len(versions); idx++ {
+			oldPage, newPage := versions[idx-1], versions[idx]
+			diffPage := &Page{
+				Path:         path.Join(newPage.Path, DiffURLElement),
+				Title:        fmt.Sprintf("Changes from %s to %s", oldPage.Title, newPage.Title),
+				IsDraft:      oldPage.IsDraft || newPage.IsDraft,
+				LastModified: newPage.LastModified,
+				ContentHTML:  template.HTML(renderDiff(oldPage, newPage)),
+				generatedBy:  "GenerateDiffPages",
+			}
+			if oldPage.LastModified.After(diffPage.LastModified) {
+				diffPage.LastModified = oldPage.LastModified
+			}
+			result = append(result, diffPage)
+
+			//the diff page is also reachable through the navigation of the newer version
+			previousLink := NavigationLink{
+				URLPath: diffPage.Path,
+				Caption: "Changes since " + oldPage.Title,
+				Title:   diffPage.Title,
+				IsDraft: diffPage.IsDraft,
+			}
+			diffPage.NavLabel = previousLink.Caption
+			nextLink := previousLink
+			nextLink.Caption = "Changes in " + newPage.Title
+			newPage.DiffToPrevious = &previousLink
+			oldPage.DiffToNext = &nextLink
+		}
+	}
+	return result
+}
+
+//A section of a Markdown source file, i.e. a heading and the text following
+//it up to the next heading.
+type diffSection struct {
+	ID      string //empty for the text before the first heading
+	Aliases []string
+	Key     string //see anchorKey()
+	Caption string
+	Lines   []string
+}
+
+func splitIntoSections(p *Page) []diffSection {
+	//CRLF line endings would otherwise make every line look changed when
+	//compared to a file with LF line endings
+	source := strings.Replace(string(p.markdownSource), "\r\n", "\n", -1)
+	lines := strings.Split(strings.TrimRight(source, "\n"), "\n")
+	var result []diffSection
+
+	//text before the first heading (usually empty since the first line is
+	//the page title, but front matter lines are empty lines in markdownSource)
+	start := len(lines)
+	if len(p.toc) > 0 {
+		start = p.toc[0].line - 1
+	}
+	if strings.TrimSpace(strings.Join(lines[:start], "")) != "" {
+		result = append(result, diffSection{Lines: lines[:start]})
+	}
+
+	for idx, e := range p.toc {
+		end := len(lines)
+		if idx+1 < len(p.toc) {
+			end = p.toc[idx+1].line - 1
+		}
+		result = append(result, diffSection{
+			ID:      e.ID,
+			Aliases: e.Aliases,
+			Key:     anchorKey(e.Caption),
+			Caption: e.Caption,
+			Lines:   trimTrailingEmptyLines(lines[e.line-1 : end]),
+		})
+	}
+	return result
+}
+
+//Blank lines between sections should not make a moved section look changed.
+func trimTrailingEmptyLines(lines []string) []string {
+	for len(lines) > 0 && strings.TrimSpace(lines[len(lines)-1]) == "" {
+		lines = lines[:len(lines)-1]
+	}
+	return lines
+}
+
+//Matches the sections of two versions of a document. Sections are matched by
+//ID first (including the aliases that the new version has for the IDs of
+//moved sections), and by caption (ignoring section numbers) second. The
+//result maps indexes of newSections to indexes of oldSections.
+func matchSections(oldSections, newSections []diffSection) map[int]int {
+	result := make(map[int]int)
+	isOldMatched := make(map[int]bool)
+	match := func(sameSection func(o, n diffSection) bool) {
+		for newIdx, n := range newSections {
+			if _, exists := result[newIdx]; exists {
+				continue
+			}
+			for oldIdx, o := range oldSections {
+				if !isOldMatched[oldIdx] && sameSection(o, n) {
+					result[newIdx] = oldIdx
+					isOldMatched[oldIdx] = true
+					break
+				}
+			}
+		}
+	}
+	match(func(o, n diffSection) bool { return o.ID == n.ID })
+	match(func(o, n diffSection) bool {
+		for _, alias := range n.Aliases {
+			if alias == o.ID {
+				return true
+			}
+		}
+		return false
+	})
+	match(func(o, n diffSection) bool { return o.Key == n.Key })
+	return result
+}
+
+func renderDiff(oldPage, newPage *Page) string {
+	oldSections := splitIntoSections(oldPage)
+	newSections := splitIntoSections(newPage)
+	matches := matchSections(oldSections, newSections)
+	isOldMatched := make(map[int]bool, len(matches))
+	for _, oldIdx := range matches {
+		isOldMatched[oldIdx] = true
+	}
+
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "<h1>Changes from %s to %s</h1>\n",
+		html.EscapeString(oldPage.Title), html.EscapeString(newPage.Title))
+	fmt.Fprintf(&buf, `<p>Comparing <a href="%s">%s</a> with <a href="%s">%s</a>.</p>`+"\n",
+		html.EscapeString(oldPage.Path), html.EscapeString(oldPage.Title),
+		html.EscapeString(newPage.Path), html.EscapeString(newPage.Title))
+
+	//removed sections are shown before the next section that still exists
+	oldIdx := 0
+	flushRemoved := func(until int) {
+		for ; oldIdx < until; oldIdx++ {
+			if !isOldMatched[oldIdx] {
+				renderDiffSection(&buf, "removed", oldPage.Path, oldSections[oldIdx], oldSections[oldIdx].Lines, nil)
+			}
+		}
+	}
+	for newIdx, n := range newSections {
+		o, exists := matches[newIdx]
+		if !exists {
+			renderDiffSection(&buf, "added", newPage.Path, n, nil, n.Lines)
+			continue
+		}
+		flushRemoved(o)
+		if oldIdx == o {
+			oldIdx++
+		}
+		class := "changed"
+		if strings.Join(oldSections[o].Lines, "\n") == strings.Join(n.Lines, "\n") {
+			class = "unchanged"
+		}
+		renderDiffSection(&buf, class, newPage.Path, n, oldSections[o].Lines, n.Lines)
+	}
+	flushRemoved(len(oldSections))
+
+	return buf.String()
+}
+
+func renderDiffSection(buf *bytes.Buffer, class, pagePath string, s diffSection, oldLines, newLines []string) {
+	fmt.Fprintf(buf, `<section class="diff-%s">`, class)
+	caption := s.Caption
+	if s.ID == "" {
+		caption = "(before the first heading)"
+	}
+	if s.ID == "" || class == "removed" {
+		fmt.Fprintf(buf, "<h2>%s</h2>", html.EscapeString(caption))
+	} else {
+		fmt.Fprintf(buf, `<h2><a href="%s#%s">%s</a></h2>`,
+			html.EscapeString(pagePath), html.EscapeString(s.ID), html.EscapeString(caption))
+	}
+	if class != "unchanged" {
+		buf.WriteString(`<pre class="diff">`)
+		renderDiffLines(buf, diffLines(oldLines, newLines))
+		buf.WriteString("</pre>")
+	}
+	buf.WriteString("</section>\n")
+}
+
+//A line in the output of diffLines.
+type diffLine struct {
+	Op   byte //' ' for unchanged lines, '-' for deletions, '+' for insertions
+	Text string
+}
+
+//Computes a line-based diff, using the longest common subsequence of both
+//inputs. This is quadratic in time and space, which is fine for the size of
+//a single section.
+func diffLines(a, b []string) []diffLine {
+	//lcs[i][j] = length of the longest common subsequence of a[i:] and b[j:]
+	lcs := make([][]int, len(a)+1)
+	for i := range lcs {
+		lcs[i] = make([]int, len(b)+1)
+	}
+	for i := len(a) - 1; i >= 0; i-- {
+		for j := len(b) - 1; j >= 0; j-- {
+			switch {
+			case a[i] == b[j]:
+				lcs[i][j] = lcs[i+1][j+1] + 1
+			case lcs[i+1][j] >= lcs[i][j+1]:
+				lcs[i][j] = lcs[i+1][j]
+			default:
+				lcs[i][j] = lcs[i][j+1]
+			}
+		}
+	}
+
+	var result []diffLine
+	i, j := 0, 0
+	for i < len(a) || j < len(b) {
+		switch {
+		case i < len(a) && j < len(b) && a[i] == b[j]:
+			result = append(result, diffLine{' ', a[i]})
+			i++
+			j++
+		case j == len(b) || (i < len(a) && lcs[i+1][j] >= lcs[i][j+1]):
+			result = append(result, diffLine{'-', a[i]})
+			i++
+		default:
+			result = append(result, diffLine{'+', b[j]})
+			j++
+		}
+	}
+	return result
+}
+
+//Renders the output of diffLines, with unchanged lines far away from any
+//changes left out.
+func renderDiffLines(buf *bytes.Buffer, lines []diffLine) {
+	isShown := make([]bool, len(lines))
+	for idx, line := range lines {
+		if line.Op == ' ' {
+			continue
+		}
+		for offset := -diffContextLines; offset <= diffContextLines; offset++ {
+			if idx+offset >= 0 && idx+offset < len(lines) {
+				isShown[idx+offset] = true
+			}
+		}
+	}
+
+	skipped := false
+	for idx, line := range lines {
+		if !isShown[idx] {
+			if !skipped {
+				buf.WriteString("<span class=\"diff-skip\">…</span>\n")
+				skipped = true
+			}
+			continue
+		}
+		skipped = false
+		text := html.EscapeString(string(line.Op) + " " + line.Text)
+		switch line.Op {
+		case '-':
+			fmt.Fprintf(buf, "<del>%s</del>\n", text)
+		case '+':
+			fmt.Fprintf(buf, "<ins>%s</ins>\n", text)
+		default:
+			fmt.Fprintf(buf, "%s\n", text)
+		}
+	}
+}
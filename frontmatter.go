@@ -0,0 +1,331 @@
+/*******************************************************************************
+*
+* Copyright 2018 Stefan Majewsky <majewsky@gmx.net>
+*
+* This program is free software: you can redistribute it and/or modify it under
+* the terms of the GNU General Public License as published by the Free Software
+* Foundation, either version 3 of the License, or (at your option) any later
+* version.
+*
+* This program is distributed in the hope that it will be useful, but WITHOUT ANY
+* WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR
+* A PARTICULAR PURPOSE. See the GNU General Public License for more details.
+*
+* You should have received a copy of the GNU General Public License along with
+* this program. If not, see <http://www.gnu.org/licenses/>.
+*
+*******************************************************************************/
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"reflect"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/BurntSushi/toml"
+	"gopkg.in/yaml.v3"
+)
+
+//FrontMatter contains the metadata that can be declared at the top of a
+//source file. There are three syntaxes for front matter: A YAML block
+//delimited by "---" lines, a TOML block delimited by "+++" lines, or (for
+//backwards compatibility) a single-line JSON object in an HTML comment:
+//
+//	<!-- {"title":"Foo","description":"Bar"} -->
+//
+//Any of these may be preceded or followed by a "<!-- draft -->" line.
+type FrontMatter struct {
+	Title          string                 `json:"title" yaml:"title" toml:"title"`
+	Description    string                 `json:"description" yaml:"description" toml:"description"`
+	Status         string                 `json:"status" yaml:"status" toml:"status"`
+	Version        string                 `json:"version" yaml:"version" toml:"version"`
+	Authors        []string               `json:"authors" yaml:"authors" toml:"authors"`
+	Date           frontMatterDate        `json:"date" yaml:"date" toml:"date"`
+	Weight         int                    `json:"weight" yaml:"weight" toml:"weight"`
+	Aliases        []string               `json:"aliases" yaml:"aliases" toml:"aliases"`
+	Tags           []string               `json:"tags" yaml:"tags" toml:"tags"`
+	Template       string                 `json:"template" yaml:"template" toml:"template"`
+	NavLabel       string                 `json:"nav_label" yaml:"nav_label" toml:"nav_label"`
+	AnchorAliases  map[string]string      `json:"anchor_aliases" yaml:"anchor_aliases" toml:"anchor_aliases"`    //key = alias, value = heading ID
+	TOC            *bool                  `json:"toc" yaml:"toc" toml:"toc"`                                     //nil if not given
+	TOCMinLevel    int                    `json:"toc_min_level" yaml:"toc_min_level" toml:"toc_min_level"`       //0 if not given
+	TOCMaxLevel    int                    `json:"toc_max_level" yaml:"toc_max_level" toml:"toc_max_level"`       //0 if not given
+	SectionNumbers string                 `json:"section_numbers" yaml:"section_numbers" toml:"section_numbers"` //empty if not given
+	SupersededBy   string                 `json:"superseded_by" yaml:"superseded_by" toml:"superseded_by"`       //empty if not given
+	Replaces       []string               `json:"replaces" yaml:"replaces" toml:"replaces"`
+	Params         map[string]interface{} `json:"params" yaml:"params" toml:"params"`
+
+	IsDraft bool `json:"-" yaml:"-" toml:"-"` //set by the "<!-- draft -->" marker
+}
+
+//A date in front matter, either as "2006-01-02" or in RFC 3339 format.
+type frontMatterDate struct {
+	Time time.Time
+}
+
+//UnmarshalText implements the encoding.TextUnmarshaler interface.
+func (d *frontMatterDate) UnmarshalText(buf []byte) error {
+	for _, layout := range []string{"2006-01-02", time.RFC3339} {
+		t, err := time.Parse(layout, string(buf))
+		if err == nil {
+			d.Time = t
+			return nil
+		}
+	}
+	return fmt.Errorf("invalid date %q (expected format: YYYY-MM-DD)", string(buf))
+}
+
+//UnmarshalYAML implements the yaml.Unmarshaler interface. This is only needed
+//because the YAML decoder does not add line numbers to errors from
+//UnmarshalText().
+func (d *frontMatterDate) UnmarshalYAML(node *yaml.Node) error {
+	err := d.UnmarshalText([]byte(node.Value))
+	if err != nil {
+		return fmt.Errorf("line %d: %s", node.Line, err.Error())
+	}
+	return nil
+}
+
+var draftMarkerRx = regexp.MustCompile(`^\s*<!--\s*draft\s*-->\s*$`)
+var jsonFrontMatterRx = regexp.MustCompile(`^<!--\s*(\{.*\})\s*-->$`)
+var lineNumberRx = regexp.MustCompile(`\b(line) (\d+)`)
+var yamlUnknownFieldRx = regexp.MustCompile(`^field (\S+) not found in type \S+$`)
+var tomlSyntaxErrorRx = regexp.MustCompile(`^Near line (\d+) `)
+
+//ParseFrontMatter extracts the front matter from the given source file
+//contents. The front matter lines are replaced by empty lines in the returned
+//Markdown, so that line numbers stay the same.
+func ParseFrontMatter(sourcePath string, content []byte) (FrontMatter, []byte, error) {
+	var fm FrontMatter
+	lines := strings.Split(string(content), "\n")
+	idx := 0
+
+	//skip over leading draft marker
+	if idx < len(lines) && draftMarkerRx.MatchString(lines[idx]) {
+		fm.IsDraft = true
+		lines[idx] = ""
+		idx++
+	}
+
+	//find front matter block
+	var err error
+	switch {
+	case idx >= len(lines):
+		//empty file
+	case lines[idx] == "---":
+		idx, err = fm.parseBlock(sourcePath, lines, idx, "---", decodeYAMLFrontMatter)
+	case lines[idx] == "+++":
+		idx, err = fm.parseBlock(sourcePath, lines, idx, "+++", decodeTOMLFrontMatter)
+	default:
+		match := jsonFrontMatterRx.FindStringSubmatch(strings.TrimSpace(lines[idx]))
+		if match != nil {
+			err = decodeJSONFrontMatter(match[1], &fm)
+			if err != nil {
+				err = fmt.Errorf("%s:%d: %s", sourcePath, idx+1, err.Error())
+			}
+			lines[idx] = ""
+			idx++
+		}
+	}
+	if err != nil {
+		return FrontMatter{}, nil, err
+	}
+
+	//the draft marker may also come after the front matter
+	if !fm.IsDraft && idx < len(lines) && draftMarkerRx.MatchString(lines[idx]) {
+		fm.IsDraft = true
+		lines[idx] = ""
+	}
+
+	err = fm.validate(sourcePath)
+	if err != nil {
+		return FrontMatter{}, nil, err
+	}
+	return fm, []byte(strings.Join(lines, "\n")), nil
+}
+
+//Checks the values that the decoders cannot check by themselves.
+func (fm FrontMatter) validate(sourcePath string) error {
+	var errs ErrorList
+	checkLevel := func(key string, level int) {
+		if level < 0 || level > 6 {
+			errs = append(errs, fmt.Errorf("%s: %s must be a heading level between 1 and 6, got %d", sourcePath, key, level))
+		}
+	}
+	checkLevel("toc_min_level", fm.TOCMinLevel)
+	checkLevel("toc_max_level", fm.TOCMaxLevel)
+	if fm.SectionNumbers != "" {
+		err := validateOneOf(SectionNumbersManual, SectionNumbersAuto)(fm.SectionNumbers)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s: section_numbers %s, got %q", sourcePath, err.Error(), fm.SectionNumbers))
+		}
+	}
+	for _, alias := range fm.Aliases {
+		if !strings.HasPrefix(alias, "/") {
+			errs = append(errs, fmt.Errorf("%s: alias %q must be an absolute URL path", sourcePath, alias))
+		}
+	}
+	errs = append(errs, fm.validateStatus(sourcePath)...)
+	if len(errs) > 0 {
+		return errs
+	}
+	return nil
+}
+
+//An error from a front matter decoder. The line number is relative to the
+//start of the front matter block (starting at 1), or 0 if unknown.
+type frontMatterError struct {
+	Line    int
+	Message string
+}
+
+type frontMatterDecoder func(block string, fm *FrontMatter) []frontMatterError
+
+//Parses the front matter block starting at lines[startIdx], and returns the
+//index of the first line after the block.
+func (fm *FrontMatter) parseBlock(sourcePath string, lines []string, startIdx int, delimiter string, decode frontMatterDecoder) (int, error) {
+	endIdx := -1
+	for idx := startIdx + 1; idx < len(lines); idx++ {
+		if lines[idx] == delimiter || (delimiter == "---" && lines[idx] == "...") {
+			endIdx = idx
+			break
+		}
+	}
+	if endIdx == -1 {
+		return 0, fmt.Errorf("%s:%d: front matter block is not terminated by %q", sourcePath, startIdx+1, delimiter)
+	}
+
+	block := strings.Join(lines[startIdx+1:endIdx], "\n")
+	fmErrs := decode(block, fm)
+	if len(fmErrs) > 0 {
+		errs := make(ErrorList, len(fmErrs))
+		for idx, fmErr := range fmErrs {
+			line := startIdx + 1 //report the opening delimiter if we don't know better
+			if fmErr.Line > 0 {
+				line = startIdx + 1 + fmErr.Line
+			}
+			errs[idx] = fmt.Errorf("%s:%d: %s", sourcePath, line, fmErr.Message)
+		}
+		return 0, errs
+	}
+
+	for idx := startIdx; idx <= endIdx; idx++ {
+		lines[idx] = ""
+	}
+	return endIdx + 1, nil
+}
+
+func decodeYAMLFrontMatter(block string, fm *FrontMatter) []frontMatterError {
+	dec := yaml.NewDecoder(strings.NewReader(block))
+	dec.KnownFields(true)
+	err := dec.Decode(fm)
+	if err == nil || err.Error() == "EOF" { //EOF = empty block
+		return nil
+	}
+
+	//yaml.v3 reports line numbers as part of the error messages; extract them
+	var msgs []string
+	if typeErr, ok := err.(*yaml.TypeError); ok {
+		msgs = typeErr.Errors
+	} else {
+		msgs = []string{strings.TrimPrefix(err.Error(), "yaml: ")}
+	}
+	var result []frontMatterError
+	for _, msg := range msgs {
+		fmErr := frontMatterError{Message: msg}
+		match := lineNumberRx.FindStringSubmatch(msg)
+		if match != nil {
+			fmErr.Line, _ = strconv.Atoi(match[2])
+			fmErr.Message = strings.TrimPrefix(strings.TrimPrefix(msg, match[0]), ": ")
+		}
+		match = yamlUnknownFieldRx.FindStringSubmatch(fmErr.Message)
+		if match != nil {
+			fmErr.Message = fmt.Sprintf("unknown field %q", match[1])
+		}
+		result = append(result, fmErr)
+	}
+	return result
+}
+
+func decodeTOMLFrontMatter(block string, fm *FrontMatter) []frontMatterError {
+	//The TOML decoder does not report line numbers for type errors, or for
+	//which key had the wrong type. So we decode each key separately, and find
+	//the line number ourselves.
+	var data map[string]toml.Primitive
+	md, err := toml.Decode(block, &data)
+	if err != nil {
+		//syntax errors look like "Near line 3 (last key parsed 'foo'): ..."
+		msg := err.Error()
+		match := tomlSyntaxErrorRx.FindStringSubmatch(msg)
+		if match != nil {
+			line, _ := strconv.Atoi(match[1])
+			return []frontMatterError{{Line: line, Message: strings.TrimPrefix(msg, match[0])}}
+		}
+		return []frontMatterError{{Message: msg}}
+	}
+
+	//find struct fields by their "toml" tags
+	fields := make(map[string]interface{})
+	v := reflect.ValueOf(fm).Elem()
+	for idx := 0; idx < v.NumField(); idx++ {
+		key := v.Type().Field(idx).Tag.Get("toml")
+		if key != "" && key != "-" {
+			fields[key] = v.Field(idx).Addr().Interface()
+		}
+	}
+
+	var result []frontMatterError
+	keys := make([]string, 0, len(data))
+	for key := range data {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		target, exists := fields[key]
+		if !exists {
+			result = append(result, frontMatterError{
+				Line:    findTOMLKey(block, key),
+				Message: fmt.Sprintf("unknown field %q", key),
+			})
+			continue
+		}
+		err := md.PrimitiveDecode(data[key], target)
+		if err != nil {
+			result = append(result, frontMatterError{
+				Line:    findTOMLKey(block, key),
+				Message: fmt.Sprintf("invalid value for %q: %s", key, strings.TrimPrefix(err.Error(), "toml: ")),
+			})
+		}
+	}
+	return result
+}
+
+//Returns the line number (starting at 1) where the given top-level key is
+//defined in a TOML document, or 0 if not found.
+func findTOMLKey(block, key string) int {
+	rx := regexp.MustCompile(`^\s*(?:"?` + regexp.QuoteMeta(key) + `"?\s*=|\[\s*` + regexp.QuoteMeta(key) + `\s*[\].])`)
+	for idx, line := range strings.Split(block, "\n") {
+		if rx.MatchString(line) {
+			return idx + 1
+		}
+	}
+	return 0
+}
+
+func decodeJSONFrontMatter(data string, fm *FrontMatter) error {
+	dec := json.NewDecoder(bytes.NewReader([]byte(data)))
+	dec.DisallowUnknownFields()
+	err := dec.Decode(fm)
+	if err != nil {
+		return errors.New("unmarshal front matter failed: " + err.Error())
+	}
+	return nil
+}
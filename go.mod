@@ -3,6 +3,7 @@ module github.com/vt6/vt6-website-build
 go 1.13
 
 require (
+	github.com/BurntSushi/toml v0.3.0
 	github.com/russross/blackfriday v2.0.0+incompatible // indirect
 	github.com/shurcooL/sanitized_anchor_name v1.0.0 // indirect
 	gitlab.com/golang-commonmark/html v0.0.0-20180917080848-cfaf75183c4a // indirect
@@ -13,4 +14,5 @@ require (
 	gitlab.com/opennota/wd v0.0.0-20180912061657-c5d65f63c638 // indirect
 	golang.org/x/text v0.3.2 // indirect
 	gopkg.in/russross/blackfriday.v2 v2.0.0 // indirect
+	gopkg.in/yaml.v3 v3.0.1
 )
@@ -0,0 +1,208 @@
+/*******************************************************************************
+*
+* Copyright 2018 Stefan Majewsky <majewsky@gmx.net>
+*
+* This program is free software: you can redistribute it and/or modify it under
+* the terms of the GNU General Public License as published by the Free Software
+* Foundation, either version 3 of the License, or (at your option) any later
+* version.
+*
+* This program is distributed in the hope that it will be useful, but WITHOUT ANY
+* WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR
+* A PARTICULAR PURPOSE. See the GNU General Public License for more details.
+*
+* You should have received a copy of the GNU General Public License along with
+* this program. If not, see <http://www.gnu.org/licenses/>.
+*
+*******************************************************************************/
+
+package main
+
+import (
+	"fmt"
+	"html"
+	"net/url"
+	"path"
+	"regexp"
+	"strings"
+
+	"gitlab.com/golang-commonmark/markdown"
+)
+
+//BrokenLink describes a link in a page that does not point to any existing
+//page, file or anchor.
+type BrokenLink struct {
+	SourcePath string //for generated pages, a description like "/std/status (generated by GenerateStatusPage)"
+	Line       int    //0 if unknown
+	Target     string
+	Reason     string
+}
+
+//Error implements the builtin/error interface.
+func (l BrokenLink) Error() string {
+	location := l.SourcePath
+	if l.Line > 0 {
+		location += fmt.Sprintf(":%d", l.Line)
+	}
+	return fmt.Sprintf("%s: broken link to %s: %s", location, l.Target, l.Reason)
+}
+
+var linkAttrRx = regexp.MustCompile(`\b(?:href|src)="([^"]*)"`)
+var idAttrRx = regexp.MustCompile(`\bid="([^"]*)"`)
+
+// ^ As in toc.go, these regexes only need to understand the HTML generated by
+// the Markdown renderer.
+
+//CheckLinks looks at all links in the content of the given pages, and reports
+//those that point to a path that is neither a page nor one of the given files,
+//or to an anchor that does not exist on the target page. Links to other
+//websites are not checked. The files are given as paths relative to the output
+//directory, so that links can be checked before anything is written.
+func CheckLinks(pages []*Page, files map[string]bool) []BrokenLink {
+	pagesByPath := make(map[string]*Page, len(pages))
+	for _, page := range pages {
+		pagesByPath[path.Clean(page.Path)] = page
+	}
+	anchorsCache := make(map[*Page]map[string]bool)
+
+	var result []BrokenLink
+	for _, page := range pages {
+		//relative links are resolved as if the page were at "/foo/bar/" since
+		//it is actually at "/foo/bar/index.html"
+		baseURL := &url.URL{Path: strings.TrimSuffix(page.Path, "/") + "/"}
+
+		//links appear in the HTML in the same order as in the source, so
+		//repeated links to the same target are matched up in order
+		linesByTarget := make(map[string][]int)
+		for _, link := range page.sourceLinks {
+			linesByTarget[link.Target] = append(linesByTarget[link.Target], link.Line)
+		}
+
+		for _, match := range linkAttrRx.FindAllStringSubmatch(string(page.ContentHTML), -1) {
+			target := html.UnescapeString(match[1])
+			line := 0
+			if lines := linesByTarget[target]; len(lines) > 0 {
+				line = lines[0]
+				linesByTarget[target] = lines[1:]
+			}
+			reason := checkLink(target, baseURL, page, pagesByPath, anchorsCache, files)
+			if reason != "" {
+				result = append(result, BrokenLink{
+					SourcePath: page.location(),
+					Line:       line,
+					Target:     target,
+					Reason:     reason,
+				})
+			}
+		}
+	}
+	return result
+}
+
+//Returns an empty string if the link is valid, or the reason why it is broken.
+func checkLink(target string, baseURL *url.URL, page *Page, pagesByPath map[string]*Page, anchorsCache map[*Page]map[string]bool, files map[string]bool) string {
+	ref, err := url.Parse(target)
+	if err != nil {
+		return "cannot parse URL: " + err.Error()
+	}
+	if ref.Scheme != "" || ref.Host != "" {
+		return "" //external link
+	}
+
+	//find target page
+	targetPage := page
+	if ref.Path != "" {
+		targetPath := path.Clean(baseURL.ResolveReference(ref).Path)
+		targetPage = pagesByPath[targetPath]
+		if targetPage == nil {
+			if files[normalizeOutputPath(targetPath)] || files[normalizeOutputPath(path.Join(targetPath, "index.html"))] {
+				return "" //link to an asset or a generated file, we cannot check fragments there
+			}
+			return "no such page or file"
+		}
+	}
+
+	//check fragment
+	if ref.Fragment == "" {
+		return ""
+	}
+	anchors, exists := anchorsCache[targetPage]
+	if !exists {
+		anchors = collectAnchors(targetPage)
+		anchorsCache[targetPage] = anchors
+	}
+	if !anchors[ref.Fragment] {
+		return fmt.Sprintf("no anchor %q on page %s", ref.Fragment, targetPage.Path)
+	}
+	return ""
+}
+
+//Returns the IDs of all headings (as recorded in the TOC) and of all other
+//elements with an "id" attribute in the page content.
+func collectAnchors(page *Page) map[string]bool {
+	anchors := map[string]bool{"top": true}
+	for _, entry := range page.toc {
+		anchors[entry.ID] = true
+	}
+	for _, match := range idAttrRx.FindAllStringSubmatch(string(page.ContentHTML), -1) {
+		anchors[html.UnescapeString(match[1])] = true
+	}
+	return anchors
+}
+
+//A link target in the Markdown source of a page, see collectSourceLinks.
+type sourceLink struct {
+	Target string
+	Line   int
+}
+
+//Records the source line of each link in the given tokens (including links in
+//inline HTML), so that CheckLinks can report where a broken link comes from.
+func collectSourceLinks(tokens []markdown.Token) []sourceLink {
+	var result []sourceLink
+	addFromHTML := func(content string, line int) {
+		for _, match := range linkAttrRx.FindAllStringSubmatchIndex(content, -1) {
+			result = append(result, sourceLink{
+				Target: html.UnescapeString(content[match[2]:match[3]]),
+				Line:   line + strings.Count(content[:match[0]], "\n"),
+			})
+		}
+	}
+
+	//the Inline tokens of table body cells do not have a Map, but each body
+	//row is exactly one line
+	inTableBody := false
+	rowLine := 0
+	for _, token := range tokens {
+		switch t := token.(type) {
+		case *markdown.TbodyOpen:
+			inTableBody = true
+			rowLine = t.Map[0]
+		case *markdown.TbodyClose:
+			inTableBody = false
+		case *markdown.TrOpen:
+			rowLine++
+		case *markdown.HTMLBlock:
+			addFromHTML(t.Content, t.Map[0]+1)
+		case *markdown.Inline:
+			line := t.Map[0] + 1
+			if inTableBody {
+				line = rowLine
+			}
+			for _, child := range t.Children {
+				switch c := child.(type) {
+				case *markdown.LinkOpen:
+					result = append(result, sourceLink{Target: c.Href, Line: line})
+				case *markdown.Image:
+					result = append(result, sourceLink{Target: c.Src, Line: line})
+				case *markdown.HTMLInline:
+					addFromHTML(c.Content, line)
+					line += strings.Count(c.Content, "\n")
+				case *markdown.Softbreak, *markdown.Hardbreak:
+					line++
+				}
+			}
+		}
+	}
+	return result
+}
@@ -0,0 +1,104 @@
+/*******************************************************************************
+*
+* Copyright 2018 Stefan Majewsky <majewsky@gmx.net>
+*
+* This program is free software: you can redistribute it and/or modify it under
+* the terms of the GNU General Public License as published by the Free Software
+* Foundation, either version 3 of the License, or (at your option) any later
+* version.
+*
+* This program is distributed in the hope that it will be useful, but WITHOUT ANY
+* WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR
+* A PARTICULAR PURPOSE. See the GNU General Public License for more details.
+*
+* You should have received a copy of the GNU General Public License along with
+* this program. If not, see <http://www.gnu.org/licenses/>.
+*
+*******************************************************************************/
+
+package main
+
+import (
+	"bytes"
+	"html/template"
+)
+
+//Index page modes, see Config.IndexPages.
+const (
+	IndexPagesGenerate = "generate"
+	IndexPagesOmit     = "omit"
+)
+
+//The content of generated listing pages. Templates can render their own
+//listing instead by looking at {{.NavigationNode}} when {{.IsListing}} is set.
+var listingContentTemplate = template.Must(template.New("listing").Funcs(navigationFuncs).Parse(
+	`<h1>{{.Caption}}</h1>
+<ul class="listing">{{range childrenByWeight .}}
+<li><a href="{{.URLPath}}">{{.Caption}}</a>{{with .Description}} - {{.}}{{end}}</li>{{end}}
+</ul>`))
+
+//GenerateListingPages creates a listing page for each node of the
+//NavigationTree that does not have a page of its own, so that links to these
+//nodes (e.g. in breadcrumbs) do not lead nowhere. The listing pages use the
+//template named by cfg.IndexTemplate if there is one, or the default template
+//otherwise.
+func GenerateListingPages(root *NavigationTree, pages []*Page, cfg Config) ([]*Page, error) {
+	templateName := ""
+	if getPageTemplate(cfg.IndexTemplate) != nil {
+		templateName = cfg.IndexTemplate
+	}
+
+	var result []*Page
+	var visit func(node *NavigationTree) error
+	visit = func(node *NavigationTree) error {
+		if !node.Exists {
+			page, err := newListingPage(node, pages, templateName)
+			if err != nil {
+				return err
+			}
+			node.IsListing = true
+			result = append(result, page)
+		}
+		for _, child := range node.SortedChildren() {
+			err := visit(child)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	return result, visit(root)
+}
+
+func newListingPage(node *NavigationTree, pages []*Page, templateName string) (*Page, error) {
+	var buf bytes.Buffer
+	err := listingContentTemplate.Execute(&buf, node)
+	if err != nil {
+		return nil, err
+	}
+
+	page := &Page{
+		Path:        node.URLPath,
+		Title:       node.Caption(),
+		IsListing:   true,
+		Template:    templateName,
+		ContentHTML: template.HTML(buf.String()),
+		generatedBy: "GenerateListingPages",
+	}
+
+	//the listing changes whenever one of the listed pages changes
+	for _, p := range pages {
+		if node.IsAncestorOf(*p) && p.LastModified.After(page.LastModified) {
+			page.LastModified = p.LastModified
+		}
+	}
+	//if all pages below this node are drafts, so is the listing
+	page.IsDraft = true
+	for _, p := range pages {
+		if node.IsAncestorOf(*p) && !p.IsDraft {
+			page.IsDraft = false
+		}
+	}
+
+	return page, nil
+}
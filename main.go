@@ -20,79 +20,155 @@ package main
 
 import (
 	"errors"
+	"flag"
 	"fmt"
+	"io/ioutil"
 	"os"
-	"path/filepath"
+	"os/signal"
+	"runtime"
+	"syscall"
 )
 
-func main() {
-	if len(os.Args) != 3 {
-		os.Stderr.Write([]byte("usage: vt6-website-build <path-to-vt6-repo> <path-to-output-dir>\n"))
-		os.Exit(1)
-	}
+const usage = `usage: vt6-website-build [--watch] [--atomic] [<options>] <path-to-vt6-repo> <path-to-output-dir>
+   or: vt6-website-build serve [--listen <address>] [<options>] <path-to-vt6-repo> [<path-to-output-dir>]
+   or: vt6-website-build --print-config [<options>] <path-to-vt6-repo> [<path-to-output-dir>]
+`
 
+func main() {
 	//avoid duplication of error-printing code
-	err := main2()
+	var err error
+	if len(os.Args) > 1 && os.Args[1] == "serve" {
+		err = mainServe(os.Args[2:])
+	} else {
+		err = mainBuild(os.Args[1:])
+	}
 	if err != nil {
 		fmt.Fprintln(os.Stderr, err.Error())
 		os.Exit(1)
 	}
 }
 
-func main2() error {
-	//first argument must be the VT6 repo, so we expect the "spec/" subdir with all the specs
-	inputDir := os.Args[1]
-	specDir := filepath.Join(inputDir, "spec")
-	fi, err := os.Stat(specDir)
-	if err != nil {
-		return err
+//Flags that are shared by all subcommands.
+type commonFlags struct {
+	TikzCacheDir *string
+	Jobs         *int
+	Strict       *bool
+	PrintConfig  *bool
+	Config       ConfigFlags
+}
+
+func parseArgs(fs *flag.FlagSet, args []string, minArgs, maxArgs int) commonFlags {
+	cf := commonFlags{
+		Config:       AddConfigFlags(fs),
+		PrintConfig:  fs.Bool("print-config", false, "print the effective configuration and exit"),
+		TikzCacheDir: fs.String("tikz-cache", os.Getenv("VT6_TIKZ_CACHE"), "directory for caching compiled TikZ pictures across runs (default: $VT6_TIKZ_CACHE, or no caching if unset)"),
+		Jobs:         fs.Int("j", runtime.NumCPU(), "number of pages to render in parallel"),
+		Strict:       fs.Bool("strict", false, "fail the build on broken links instead of just reporting them"),
 	}
-	if !fi.IsDir() {
-		return errors.New(specDir + ": not a directory")
+	fs.Usage = func() {
+		os.Stderr.Write([]byte(usage))
+		fs.PrintDefaults()
 	}
+	fs.Parse(args) //with flag.ExitOnError, this does not return an error
+	if *cf.PrintConfig {
+		minArgs = 1
+	}
+	if fs.NArg() < minArgs || fs.NArg() > maxArgs {
+		fs.Usage()
+		os.Exit(1)
+	}
+	return cf
+}
 
-	//load templates
-	err = initPageTemplate(inputDir)
+func mainBuild(args []string) error {
+	fs := flag.NewFlagSet("vt6-website-build", flag.ExitOnError)
+	watch := fs.Bool("watch", false, "keep running and rebuild whenever input files change")
+	atomic := fs.Bool("atomic", false, "assemble the output in a staging directory next to the output directory, and only replace the output directory once the build succeeded (files not written by the build, e.g. a .git directory, do not survive this)")
+	cf := parseArgs(fs, args, 2, 2)
+
+	b, err := prepareBuilder(fs.Arg(0), fs.Arg(1), cf)
 	if err != nil {
 		return err
 	}
+	b.AtomicPublish = *atomic
+	err = b.Build()
+	if !*watch {
+		return err
+	}
 
-	//second argument must be a directory, but we create it on first run
-	outputDir := os.Args[2]
-	err = os.MkdirAll(outputDir, 0777)
+	//in watch mode, a broken initial build is not fatal since the user is
+	//probably about to fix it
 	if err != nil {
-		return err
+		fmt.Fprintln(os.Stderr, "ERROR: "+err.Error())
 	}
+	fmt.Fprintln(os.Stderr, "watching for changes...")
+	Watch(b, nil)
+	return nil
+}
 
-	//render source files
-	sourceFiles, err := FindSourceFiles(inputDir)
+func mainServe(args []string) error {
+	fs := flag.NewFlagSet("vt6-website-build serve", flag.ExitOnError)
+	listenAddress := fs.String("listen", "localhost:8080", "address for the HTTP server to listen on")
+	cf := parseArgs(fs, args, 1, 2)
+
+	b, err := prepareBuilder(fs.Arg(0), fs.Arg(1), cf)
 	if err != nil {
 		return err
 	}
-	pages := make([]*Page, len(sourceFiles))
-	for idx, sourceFile := range sourceFiles {
-		page, err := sourceFile.Render()
+
+	//without an explicit output directory, build into a temporary one
+	if b.OutputDir == "" {
+		b.OutputDir, err = ioutil.TempDir("", "vt6-website-build-serve-")
 		if err != nil {
 			return err
 		}
-		pages[idx] = &page
+		defer os.RemoveAll(b.OutputDir)
+		//Serve() only returns on error, so the deferred cleanup also needs to
+		//happen when we're interrupted
+		go func() {
+			signals := make(chan os.Signal, 1)
+			signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+			<-signals
+			os.RemoveAll(b.OutputDir)
+			os.Exit(0)
+		}()
 	}
-	navTree := NewNavigationTree(sourceFiles)
-	for _, page := range pages {
-		page.AddNavigation(navTree)
+
+	err = b.Build()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "ERROR: "+err.Error())
 	}
+	fmt.Fprintf(os.Stderr, "serving %s on http://%s/\n", b.OutputDir, *listenAddress)
+	return Serve(b, *listenAddress)
+}
 
-	//write resulting HTML pages to output directory
-	for _, page := range pages {
-		err = page.WriteTo(outputDir)
+func prepareBuilder(inputDir, outputDir string, cf commonFlags) (*Builder, error) {
+	cfg, err := LoadConfig(inputDir, cf.Config)
+	if err != nil {
+		return nil, err
+	}
+	if *cf.PrintConfig {
+		err := cfg.Print()
 		if err != nil {
-			return err
+			return nil, err
 		}
+		os.Exit(0)
+	}
+
+	//first argument must be the VT6 repo, so we expect the "spec/" subdir with all the specs
+	specDir := cfg.InputPath(cfg.SpecDir)
+	fi, err := os.Stat(specDir)
+	if err != nil {
+		return nil, err
+	}
+	if !fi.IsDir() {
+		return nil, errors.New(specDir + ": not a directory")
 	}
 
-	//copy static assets
-	return CopyAssets(
-		filepath.Join(inputDir, "website/static"),
-		filepath.Join(outputDir, "static"),
-	)
+	//second argument must be a directory, but the Builder creates it on first run
+	b := NewBuilder(cfg, outputDir)
+	b.Jobs = *cf.Jobs
+	b.StrictLinks = *cf.Strict
+	b.TikzCache, err = NewTikzCache(*cf.TikzCacheDir)
+	return b, err
 }
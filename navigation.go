@@ -19,6 +19,7 @@
 package main
 
 import (
+	"html/template"
 	"path/filepath"
 	"sort"
 	"strings"
@@ -26,8 +27,11 @@ import (
 
 //NavigationLink describes an entry in a Page's navigation bar.
 type NavigationLink struct {
-	URLPath string
-	Caption string
+	URLPath     string
+	Caption     string //short label, e.g. "vt6/core1.0" (or the last path element if there is no page)
+	Title       string //empty if there is no page at this path
+	Description string
+	IsDraft     bool
 }
 
 //NavigationTree is a tree datastructure describing which pages exist and can
@@ -37,66 +41,201 @@ type NavigationTree struct {
 	Parent   *NavigationTree
 	Children map[string]*NavigationTree
 	Exists   bool //whether there is a page at this point
+	//whether a listing page was generated for this node (only if !Exists)
+	IsListing bool
+	//whether the page at this point was generated (e.g. the status page)
+	//instead of being rendered from a source file
+	IsGenerated bool
+	//the following fields are only filled if Exists is true
+	Title       string
+	Description string
+	NavLabel    string //from the page's front matter; overrides Title as link caption
+	IsDraft     bool
+	Weight      int //from the page's front matter; siblings with lower weight come first
 }
 
-//NewNavigationTree prepares a NavigationTree for the given set of source files.
-func NewNavigationTree(sourceFiles []SourceFile) *NavigationTree {
+//NewNavigationTree prepares a NavigationTree for the given set of pages.
+func NewNavigationTree(pages []*Page) *NavigationTree {
 	root := &NavigationTree{
 		URLPath:  "/",
 		Children: make(map[string]*NavigationTree),
 	}
 
-	for _, sf := range sourceFiles {
-		ntLocate(root, sf.URLPath, true).Exists = true
+	for _, page := range pages {
+		tree := ntLocate(root, page.Path, true)
+		tree.Exists = true
+		tree.Title = page.Title
+		tree.Description = page.Description
+		tree.NavLabel = page.NavLabel
+		tree.IsDraft = page.IsDraft
+		tree.Weight = page.Weight
+		tree.IsGenerated = page.generatedBy != ""
 	}
 
 	return root
 }
 
-//AddNavigation populates the Page.UpwardsNavigation and Page.DownwardsNavigation.
+//SortedChildren returns the children of this node, ordered by weight first and
+//by name second. Names are compared such that numbers within them are ordered
+//numerically, e.g. "1.2" comes before "1.10".
+func (t *NavigationTree) SortedChildren() []*NavigationTree {
+	result := make([]*NavigationTree, 0, len(t.Children))
+	for _, child := range t.Children {
+		result = append(result, child)
+	}
+	sort.SliceStable(result, func(i, j int) bool {
+		if result[i].Weight != result[j].Weight {
+			return result[i].Weight < result[j].Weight
+		}
+		return naturalLess(result[i].URLPath, result[j].URLPath)
+	})
+	return result
+}
+
+//Caption returns the label for links to this node.
+func (t *NavigationTree) Caption() string {
+	switch {
+	case t.NavLabel != "":
+		return t.NavLabel
+	case t.Title != "":
+		return t.Title
+	default:
+		return filepath.Base(t.URLPath)
+	}
+}
+
+//Link returns a NavigationLink pointing to this node.
+func (t *NavigationTree) Link() NavigationLink {
+	return NavigationLink{
+		URLPath:     t.URLPath,
+		Caption:     t.Caption(),
+		Title:       t.Title,
+		Description: t.Description,
+		IsDraft:     t.IsDraft,
+	}
+}
+
+//IsAncestorOf returns whether the given page is strictly below this node.
+func (t *NavigationTree) IsAncestorOf(p Page) bool {
+	if t.URLPath == "/" {
+		return p.Path != "/"
+	}
+	return strings.HasPrefix(p.Path, t.URLPath+"/")
+}
+
+//IsCurrentPage returns whether this node is the given page.
+func (t *NavigationTree) IsCurrentPage(p Page) bool {
+	return t.URLPath == p.Path
+}
+
+//NavigationContext pairs a NavigationTree node with the page that is being
+//rendered. Since templates can only pass a single value to {{template}}, this is
+//needed to render the tree recursively (see README).
+type NavigationContext struct {
+	Node *NavigationTree
+	Page Page
+}
+
+//Functions available in page templates for working with the NavigationTree.
+var navigationFuncs = template.FuncMap{
+	"childrenByWeight": func(t *NavigationTree) []*NavigationTree { return t.SortedChildren() },
+	"isAncestorOf":     func(t *NavigationTree, p Page) bool { return t.IsAncestorOf(p) },
+	"isCurrentPage":    func(t *NavigationTree, p Page) bool { return t.IsCurrentPage(p) },
+	"withPage":         func(t *NavigationTree, p Page) NavigationContext { return NavigationContext{t, p} },
+}
+
+//AddNavigation populates the Page.UpwardsNavigation, Page.DownwardsNavigation,
+//Page.PreviousPage, Page.NextPage, Page.NavigationRoot and Page.NavigationNode.
 func (p *Page) AddNavigation(root *NavigationTree) {
-	//upwards navigation (this is computed based on the path only for now, might change later)
+	tree := ntLocate(root, p.Path, false)
+	p.NavigationRoot = root
+	p.NavigationNode = tree
+
+	//upwards navigation
 	//NOTE: We do not need a link to URLPath = "/" - The VT6 logo in the header serves that purpose.
-	if p.Path == "/" {
-		p.UpwardsNavigation = nil
-	} else {
-		pathElements := strings.Split(strings.TrimLeft(p.Path, "/"), "/")
-		for idx := range pathElements {
-			p.UpwardsNavigation = append(p.UpwardsNavigation, NavigationLink{
-				URLPath: "/" + strings.Join(pathElements[0:idx+1], "/"),
-				Caption: pathElements[idx],
-			})
+	//Nodes without a page (and without a generated listing page) are skipped
+	//since there is nothing to link to.
+	p.UpwardsNavigation = nil
+	for node := tree; node != root; node = node.Parent {
+		if node.Exists || node.IsListing {
+			p.UpwardsNavigation = append([]NavigationLink{node.Link()}, p.UpwardsNavigation...)
 		}
 	}
 
 	//downwards navigation
-	tree := ntLocate(root, p.Path, false)
-	p.DownwardsNavigation = nil
-	for _, child := range tree.Children {
-		p.DownwardsNavigation = append(p.DownwardsNavigation,
-			ntCollectDownwardsNav(tree, child)...,
-		)
+	p.DownwardsNavigation = ntCollectDownwardsNav(tree)
+
+	//previous/next page are the neighbors of this page in the reading order
+	//of the closest ancestor page (or listing page, so that the reading order
+	//does not cross from one module into the next); generated pages are not
+	//part of the reading order
+	p.PreviousPage = nil
+	p.NextPage = nil
+	if p.generatedBy != "" {
+		return
 	}
+	ancestor := tree.Parent
+	for ancestor != nil && !ancestor.Exists && !ancestor.IsListing {
+		ancestor = ancestor.Parent
+	}
+	if ancestor == nil {
+		return
+	}
+	siblings := ntCollectReadingOrder(ancestor)
+	for idx, link := range siblings {
+		if link.URLPath != p.Path {
+			continue
+		}
+		if idx > 0 {
+			p.PreviousPage = &siblings[idx-1]
+		}
+		if idx < len(siblings)-1 {
+			p.NextPage = &siblings[idx+1]
+		}
+		break
+	}
+}
 
-	sort.Slice(p.DownwardsNavigation, func(i, j int) bool {
-		return p.DownwardsNavigation[i].URLPath < p.DownwardsNavigation[j].URLPath
-	})
+//Returns the links to all pages below this node that can be navigated to
+//directly from it, in the order given by SortedChildren().
+func ntCollectDownwardsNav(tree *NavigationTree) []NavigationLink {
+	var links []NavigationLink
+	for _, child := range tree.SortedChildren() {
+		links = append(links, ntCollectDownwardsNavFor(tree, child)...)
+	}
+	return links
 }
 
-func ntCollectDownwardsNav(tree *NavigationTree, child *NavigationTree) []NavigationLink {
+func ntCollectDownwardsNavFor(tree *NavigationTree, child *NavigationTree) []NavigationLink {
 	//when a child exists, we can navigate to it...
 	if child.Exists {
-		relPath, _ := filepath.Rel(tree.URLPath, child.URLPath)
-		return []NavigationLink{{
-			URLPath: child.URLPath,
-			Caption: relPath,
-		}}
+		return []NavigationLink{child.Link()}
 	}
 
 	//...otherwise we need to offer a way to navigate its children
 	var links []NavigationLink
-	for _, grandchild := range child.Children {
-		links = append(links, ntCollectDownwardsNav(tree, grandchild)...)
+	for _, grandchild := range child.SortedChildren() {
+		links = append(links, ntCollectDownwardsNavFor(tree, grandchild)...)
+	}
+	return links
+}
+
+//Like ntCollectDownwardsNav, but leaves out generated pages, and does not
+//descend into nodes with a listing page since those have a reading order of
+//their own.
+func ntCollectReadingOrder(tree *NavigationTree) []NavigationLink {
+	var links []NavigationLink
+	for _, child := range tree.SortedChildren() {
+		switch {
+		case child.Exists:
+			if !child.IsGenerated {
+				links = append(links, child.Link())
+			}
+		case child.IsListing:
+			continue
+		default:
+			links = append(links, ntCollectReadingOrder(child)...)
+		}
 	}
 	return links
 }
@@ -129,3 +268,46 @@ func ntLocate(root *NavigationTree, urlPath string, createMissing bool) *Navigat
 
 	return current
 }
+
+//Compares two strings such that runs of digits are compared by their numeric
+//value, e.g. "core/1.2" < "core/1.10". Strings that only differ in leading
+//zeroes (e.g. "1" and "01") are compared as plain strings, so that the order is
+//total and sorting results do not depend on the input order.
+func naturalLess(a, b string) bool {
+	origA, origB := a, b
+	for a != "" && b != "" {
+		aChunk, aIsNum := nextNaturalChunk(a)
+		bChunk, bIsNum := nextNaturalChunk(b)
+		a = a[len(aChunk):]
+		b = b[len(bChunk):]
+
+		if aIsNum && bIsNum {
+			aTrimmed := strings.TrimLeft(aChunk, "0")
+			bTrimmed := strings.TrimLeft(bChunk, "0")
+			if len(aTrimmed) != len(bTrimmed) {
+				return len(aTrimmed) < len(bTrimmed)
+			}
+			if aTrimmed != bTrimmed {
+				return aTrimmed < bTrimmed
+			}
+		} else if aChunk != bChunk {
+			return aChunk < bChunk
+		}
+	}
+	if len(a) != len(b) {
+		return len(a) < len(b)
+	}
+	return origA < origB
+}
+
+//Returns the longest prefix of `s` that consists only of digits or only of
+//non-digits, and whether it's the former.
+func nextNaturalChunk(s string) (string, bool) {
+	isDigit := func(c byte) bool { return c >= '0' && c <= '9' }
+	isNum := isDigit(s[0])
+	idx := 1
+	for idx < len(s) && isDigit(s[idx]) == isNum {
+		idx++
+	}
+	return s[:idx], isNum
+}
@@ -0,0 +1,226 @@
+/*******************************************************************************
+*
+* Copyright 2018 Stefan Majewsky <majewsky@gmx.net>
+*
+* This program is free software: you can redistribute it and/or modify it under
+* the terms of the GNU General Public License as published by the Free Software
+* Foundation, either version 3 of the License, or (at your option) any later
+* version.
+*
+* This program is distributed in the hope that it will be useful, but WITHOUT ANY
+* WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR
+* A PARTICULAR PURPOSE. See the GNU General Public License for more details.
+*
+* You should have received a copy of the GNU General Public License along with
+* this program. If not, see <http://www.gnu.org/licenses/>.
+*
+*******************************************************************************/
+
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+)
+
+//ManifestFileName is the name of the file in the output directory that lists
+//all files written by the previous build.
+const ManifestFileName = ".build-manifest"
+
+//OutputDir is the directory where the website is written to. It remembers
+//which files were written, so that files from previous builds that are not
+//part of the website anymore can be cleaned up afterwards. All methods are safe
+//for concurrent use.
+type OutputDir struct {
+	Path string
+	//If there is no manifest yet (e.g. in an output directory from before
+	//manifests were introduced), files for which this returns true are
+	//treated as if they were written by the previous build. May be nil.
+	ClaimWithoutManifest func(relPath string) bool
+	mutex                sync.Mutex
+	written              map[string]bool //keys are slash-separated paths relative to Path
+}
+
+//NewOutputDir prepares an OutputDir, creating the directory if necessary.
+func NewOutputDir(path string) (*OutputDir, error) {
+	err := os.MkdirAll(path, 0777)
+	return &OutputDir{Path: path, written: make(map[string]bool)}, err
+}
+
+//WriteFile writes a file at the given path relative to the output directory.
+func (o *OutputDir) WriteFile(relPath string, content []byte) error {
+	relPath = normalizeOutputPath(relPath)
+	o.mutex.Lock()
+	o.written[relPath] = true
+	o.mutex.Unlock()
+	return mkdirAllAndWriteFile(filepath.Join(o.Path, relPath), content)
+}
+
+//Page paths have a leading slash, e.g. "/std/core/1.0/index.html", but
+//manifest entries do not.
+func normalizeOutputPath(relPath string) string {
+	return strings.TrimPrefix(filepath.ToSlash(filepath.Clean("/"+relPath)), "/")
+}
+
+//Finalize removes all files that were written by the previous build, but not
+//by this one, then records the files written by this build in the manifest.
+//Files that were not written by any build (e.g. a .git directory when the
+//output directory is a repository) are left alone.
+func (o *OutputDir) Finalize() error {
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+
+	oldPaths, err := o.readManifest()
+	if err != nil {
+		return err
+	}
+	for _, relPath := range oldPaths {
+		if o.written[relPath] {
+			continue
+		}
+		err := removeFileAndEmptyParents(o.Path, relPath)
+		if err != nil {
+			return err
+		}
+	}
+
+	return o.writeManifest(nil)
+}
+
+//Abort is used instead of Finalize when the build failed halfway. No files are
+//removed, but the files written so far are added to the manifest, so that the
+//next successful build cleans them up if they are not part of the website
+//anymore.
+func (o *OutputDir) Abort() error {
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+
+	oldPaths, err := o.readManifest()
+	if err != nil {
+		return err
+	}
+	return o.writeManifest(oldPaths)
+}
+
+func (o *OutputDir) readManifest() ([]string, error) {
+	buf, err := ioutil.ReadFile(filepath.Join(o.Path, ManifestFileName))
+	if os.IsNotExist(err) {
+		return o.claimFiles()
+	}
+	if err != nil {
+		return nil, err
+	}
+	var paths []string
+	for _, relPath := range strings.Split(string(buf), "\n") {
+		if relPath != "" {
+			paths = append(paths, relPath)
+		}
+	}
+	return paths, nil
+}
+
+//Lists the files that are selected by ClaimWithoutManifest. Hidden
+//directories (e.g. .git) are skipped.
+func (o *OutputDir) claimFiles() ([]string, error) {
+	if o.ClaimWithoutManifest == nil {
+		return nil, nil
+	}
+	var paths []string
+	err := filepath.Walk(o.Path, func(path string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		relPath, _ := filepath.Rel(o.Path, path)
+		relPath = filepath.ToSlash(relPath)
+		if fi.IsDir() {
+			if relPath != "." && strings.HasPrefix(fi.Name(), ".") {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if o.ClaimWithoutManifest(relPath) {
+			paths = append(paths, relPath)
+		}
+		return nil
+	})
+	return paths, err
+}
+
+//Writes a manifest listing the files written by this build, plus the given
+//extra paths.
+func (o *OutputDir) writeManifest(extraPaths []string) error {
+	isListed := make(map[string]bool)
+	for _, relPath := range extraPaths {
+		isListed[relPath] = true
+	}
+	for relPath := range o.written {
+		isListed[relPath] = true
+	}
+
+	var paths []string
+	for relPath := range isListed {
+		paths = append(paths, relPath)
+	}
+	sort.Strings(paths)
+	content := []byte(strings.Join(paths, "\n") + "\n")
+	return ioutil.WriteFile(filepath.Join(o.Path, ManifestFileName), content, 0666)
+}
+
+func removeFileAndEmptyParents(rootDir, relPath string) error {
+	//do not follow manifest entries out of the output directory
+	relPath = filepath.Clean(filepath.FromSlash(relPath))
+	if filepath.IsAbs(relPath) || relPath == ".." || strings.HasPrefix(relPath, ".."+string(filepath.Separator)) {
+		return nil
+	}
+
+	err := os.Remove(filepath.Join(rootDir, relPath))
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	for dir := filepath.Dir(relPath); dir != "."; dir = filepath.Dir(dir) {
+		//this fails if the directory is not empty, which is what we want
+		if os.Remove(filepath.Join(rootDir, dir)) != nil {
+			break
+		}
+	}
+	return nil
+}
+
+//Publishes a freshly built staging directory by putting it in place of the
+//output directory. The old output directory is removed.
+//
+//This is not strictly atomic since there are two renames, but the window where
+//no output directory exists is as short as we can make it without requiring
+//the output directory to be a symlink.
+func swapOutputDir(stagingDir, outputDir string) error {
+	oldDir := stagingDir + ".old"
+	err := os.Rename(outputDir, oldDir)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	hadOldDir := err == nil
+
+	err = os.Rename(stagingDir, outputDir)
+	if err != nil {
+		if hadOldDir {
+			os.Rename(oldDir, outputDir)
+		}
+		return err
+	}
+	if hadOldDir {
+		return os.RemoveAll(oldDir)
+	}
+	return nil
+}
+
+func mkdirAllAndWriteFile(path string, content []byte) error {
+	err := os.MkdirAll(filepath.Dir(path), 0777)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(path, content, 0666)
+}
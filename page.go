@@ -20,21 +20,73 @@ package main
 
 import (
 	"bytes"
+	"fmt"
 	"html/template"
 	"io/ioutil"
-	"os"
 	"path/filepath"
+	"strings"
+	"sync"
+	"time"
 )
 
-var pageTmpl *template.Template
+var (
+	//key = template name, e.g. "page" for "page.html.tpl"
+	pageTemplates       map[string]*template.Template
+	defaultTemplateName string
+	//pageTemplates is replaced when templates change in watch mode
+	pageTemplatesMutex sync.RWMutex
+)
+
+//Template files are recognized by this suffix.
+const templateSuffix = ".html.tpl"
 
-func initPageTemplate(inputDir string) error {
-	content, err := ioutil.ReadFile(filepath.Join(inputDir, "website/templates/page.html.tpl"))
+//Loads the default page template from the given path, as well as all other
+//templates in the same directory. Pages can choose one of those other
+//templates with the "template" key in their front matter.
+func initPageTemplates(defaultPath string) error {
+	templates := make(map[string]*template.Template)
+	defaultName := strings.TrimSuffix(filepath.Base(defaultPath), templateSuffix)
+	paths, err := filepath.Glob(filepath.Join(filepath.Dir(defaultPath), "*"+templateSuffix))
 	if err != nil {
 		return err
 	}
-	pageTmpl, err = template.New("page").Parse(string(content))
-	return err
+	//the glob does not find the default template if it has an unusual name
+	if !strings.HasSuffix(defaultPath, templateSuffix) {
+		paths = append(paths, defaultPath)
+	}
+
+	for _, path := range paths {
+		content, err := ioutil.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		name := strings.TrimSuffix(filepath.Base(path), templateSuffix)
+		tmpl, err := template.New(name).Funcs(navigationFuncs).Parse(string(content))
+		if err != nil {
+			return err
+		}
+		templates[name] = tmpl
+	}
+	if templates[defaultName] == nil {
+		return fmt.Errorf("read %s: no such file", defaultPath)
+	}
+
+	pageTemplatesMutex.Lock()
+	pageTemplates = templates
+	defaultTemplateName = defaultName
+	pageTemplatesMutex.Unlock()
+	return nil
+}
+
+//Returns the template with the given name, or the default template if the name
+//is empty.
+func getPageTemplate(name string) *template.Template {
+	pageTemplatesMutex.RLock()
+	defer pageTemplatesMutex.RUnlock()
+	if name == "" {
+		name = defaultTemplateName
+	}
+	return pageTemplates[name]
 }
 
 //Asset represents a static file that is used by a Page.
@@ -49,26 +101,70 @@ type Page struct {
 	Title               string
 	Description         string
 	IsDraft             bool
+	IsListing           bool            //whether this page was generated by GenerateListingPages
+	Status              string          //one of the Status... constants, or empty if not given
+	SupersededBy        *NavigationLink //nil if not given
+	Replaces            []NavigationLink
+	Version             string
+	NewerVersion        *NavigationLink //the latest version of this module, or nil if this is the latest version
+	DiffToPrevious      *NavigationLink //the page comparing this version to the previous version, if any
+	DiffToNext          *NavigationLink //the page comparing this version to the next version, if any
+	Authors             []string
+	Date                time.Time //zero if not given
+	Weight              int
+	Aliases             []string
+	Tags                []string
+	Template            string //empty for default template
+	NavLabel            string //empty if not given
+	Params              map[string]interface{}
+	LastModified        time.Time
 	ContentHTML         template.HTML
+	TableOfContents     []*TOCItem //nil if the TOC is disabled for this page
 	TableOfContentsHTML template.HTML
 	UpwardsNavigation   []NavigationLink
 	DownwardsNavigation []NavigationLink
+	PreviousPage        *NavigationLink //nil if there is none
+	NextPage            *NavigationLink //nil if there is none
+	NavigationRoot      *NavigationTree //the whole site, shared between all pages
+	NavigationNode      *NavigationTree //the node for this page within NavigationRoot
 	Assets              []Asset
+
+	sourcePath       string //empty for generated pages
+	sourceURLPath    string //differs from Path for drafts in BuildModeSplit
+	generatedBy      string //the function that generated this page, empty for pages with a source file
+	supersededByPath string
+	replacesPaths    []string
+	toc              []TOCEntry
+	markdownSource   []byte //without front matter, for GenerateDiffPages
+	searchSections   []SearchSection
+	sourceLinks      []sourceLink
+}
+
+//Describes where this page comes from, for error messages.
+func (p Page) location() string {
+	if p.sourcePath == "" {
+		return fmt.Sprintf("%s (generated by %s)", p.Path, p.generatedBy)
+	}
+	return p.sourcePath
 }
 
 //WriteTo writes the HTML for this page to the corresponding path in the output
 //directory.
-func (p Page) WriteTo(outputDir string) error {
+func (p Page) WriteTo(out *OutputDir) error {
 	p.Path = filepath.Clean(p.Path)
 
+	tmpl := getPageTemplate(p.Template)
+	if tmpl == nil {
+		return fmt.Errorf("%s: unknown template %q", p.location(), p.Template)
+	}
 	var buf bytes.Buffer
-	err := pageTmpl.Execute(&buf, p)
+	err := tmpl.Execute(&buf, p)
 	if err != nil {
 		return err
 	}
 
-	err = mkdirAllAndWriteFile(
-		filepath.Join(outputDir, p.Path, "index.html"),
+	err = out.WriteFile(
+		filepath.Join(p.Path, "index.html"),
 		append(bytes.TrimSpace(buf.Bytes()), '\n'),
 	)
 	if err != nil {
@@ -76,7 +172,7 @@ func (p Page) WriteTo(outputDir string) error {
 	}
 
 	for _, asset := range p.Assets {
-		err = mkdirAllAndWriteFile(filepath.Join(outputDir, asset.Path), asset.Content)
+		err = out.WriteFile(asset.Path, asset.Content)
 		if err != nil {
 			return err
 		}
@@ -84,11 +180,3 @@ func (p Page) WriteTo(outputDir string) error {
 
 	return nil
 }
-
-func mkdirAllAndWriteFile(path string, content []byte) error {
-	err := os.MkdirAll(filepath.Dir(path), 0777)
-	if err != nil {
-		return err
-	}
-	return ioutil.WriteFile(path, content, 0666)
-}
@@ -0,0 +1,74 @@
+/*******************************************************************************
+*
+* Copyright 2018 Stefan Majewsky <majewsky@gmx.net>
+*
+* This program is free software: you can redistribute it and/or modify it under
+* the terms of the GNU General Public License as published by the Free Software
+* Foundation, either version 3 of the License, or (at your option) any later
+* version.
+*
+* This program is distributed in the hope that it will be useful, but WITHOUT ANY
+* WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR
+* A PARTICULAR PURPOSE. See the GNU General Public License for more details.
+*
+* You should have received a copy of the GNU General Public License along with
+* this program. If not, see <http://www.gnu.org/licenses/>.
+*
+*******************************************************************************/
+
+package main
+
+import (
+	"strings"
+	"sync"
+)
+
+//ErrorList is an error that wraps multiple errors.
+type ErrorList []error
+
+//Error implements the builtin/error interface.
+func (errs ErrorList) Error() string {
+	msgs := make([]string, len(errs))
+	for idx, err := range errs {
+		msgs[idx] = err.Error()
+	}
+	return strings.Join(msgs, "\n")
+}
+
+//forEachParallel calls action(idx) for each idx in [0, count), using at most
+//`jobs` goroutines at once. Errors do not abort the iteration; instead, all of
+//them are collected and returned as an ErrorList, in order of their index.
+func forEachParallel(jobs, count int, action func(idx int) error) error {
+	if jobs < 1 {
+		jobs = 1
+	}
+	errs := make([]error, count)
+
+	indexes := make(chan int)
+	var wg sync.WaitGroup
+	for worker := 0; worker < jobs && worker < count; worker++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for idx := range indexes {
+				errs[idx] = action(idx)
+			}
+		}()
+	}
+	for idx := 0; idx < count; idx++ {
+		indexes <- idx
+	}
+	close(indexes)
+	wg.Wait()
+
+	var result ErrorList
+	for _, err := range errs {
+		if err != nil {
+			result = append(result, err)
+		}
+	}
+	if len(result) == 0 {
+		return nil
+	}
+	return result
+}
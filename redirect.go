@@ -0,0 +1,221 @@
+/*******************************************************************************
+*
+* Copyright 2018 Stefan Majewsky <majewsky@gmx.net>
+*
+* This program is free software: you can redistribute it and/or modify it under
+* the terms of the GNU General Public License as published by the Free Software
+* Foundation, either version 3 of the License, or (at your option) any later
+* version.
+*
+* This program is distributed in the hope that it will be useful, but WITHOUT ANY
+* WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR
+* A PARTICULAR PURPOSE. See the GNU General Public License for more details.
+*
+* You should have received a copy of the GNU General Public License along with
+* this program. If not, see <http://www.gnu.org/licenses/>.
+*
+*******************************************************************************/
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"html/template"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+var redirectTemplate = template.Must(template.New("redirect").Parse(
+	`<!DOCTYPE html>
+<html><head>
+<meta charset="utf-8">
+<title>Redirecting to {{.}}</title>
+<link rel="canonical" href="{{.}}">
+<meta http-equiv="refresh" content="0; url={{.}}">
+</head><body>
+<p>Redirecting to <a href="{{.}}">{{.}}</a>.</p>
+</body></html>
+`))
+
+//WriteRedirect writes a stub page at the given URL path in the output
+//directory, which sends browsers to the given target URL.
+func WriteRedirect(out *OutputDir, urlPath, target string) error {
+	var buf bytes.Buffer
+	err := redirectTemplate.Execute(&buf, target)
+	if err != nil {
+		return err
+	}
+	return out.WriteFile(filepath.Join(urlPath, "index.html"), buf.Bytes())
+}
+
+//Redirect describes a URL path that sends browsers to a different URL.
+type Redirect struct {
+	From      string //a URL path, e.g. "/std/core1.0"
+	To        string //a URL path or an absolute URL
+	Source    string //where this redirect was declared, for error messages
+	Permanent bool   //whether servers should answer with 301 instead of 302
+}
+
+//StatusCode returns the HTTP status code that servers should use for this
+//redirect.
+func (r Redirect) StatusCode() int {
+	if r.Permanent {
+		return 301
+	}
+	return 302
+}
+
+//Output formats for redirects, see Config.RedirectFormats.
+const (
+	RedirectFormatHTML    = "html"    //stub pages with <meta http-equiv="refresh">
+	RedirectFormatNetlify = "netlify" //a "_redirects" file
+	RedirectFormatNginx   = "nginx"   //a file that can be included in an nginx map block
+)
+
+var allRedirectFormats = []string{RedirectFormatHTML, RedirectFormatNetlify, RedirectFormatNginx}
+
+//Names of the files written for RedirectFormatNetlify and RedirectFormatNginx.
+//Since an nginx map cannot carry the status code, permanent and temporary
+//redirects go into separate files for nginx.
+const (
+	NetlifyRedirectsFileName        = "_redirects"
+	NginxRedirectsFileName          = "nginx-redirects.map"
+	NginxTemporaryRedirectsFileName = "nginx-redirects-temporary.map"
+)
+
+//LoadRedirectsFile reads the site-wide redirects file. Each line contains the
+//URL path to redirect from and the URL to redirect to, separated by
+//whitespace. Empty lines and lines starting with "#" are ignored. If the file
+//does not exist, no redirects are returned.
+func LoadRedirectsFile(filePath string) ([]Redirect, error) {
+	buf, err := ioutil.ReadFile(filePath)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	var (
+		result []Redirect
+		errs   ErrorList
+	)
+	for idx, line := range strings.Split(string(buf), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Fields(line)
+		if len(fields) != 2 {
+			errs = append(errs, fmt.Errorf("%s:%d: expected two fields (from and to), got %d", filePath, idx+1, len(fields)))
+			continue
+		}
+		if !strings.HasPrefix(fields[0], "/") {
+			errs = append(errs, fmt.Errorf("%s:%d: %q must be an absolute URL path", filePath, idx+1, fields[0]))
+			continue
+		}
+		result = append(result, Redirect{
+			From:      path.Clean(fields[0]),
+			To:        fields[1],
+			Source:    fmt.Sprintf("%s:%d", filePath, idx+1),
+			Permanent: true,
+		})
+	}
+	if len(errs) > 0 {
+		return nil, errs
+	}
+	return result, nil
+}
+
+//CollectRedirects assembles the redirects from the "aliases" in the front
+//matter of the given pages and from the redirects file. It is an error if a
+//redirect would replace one of the pages, or if there are multiple redirects
+//for the same path.
+func CollectRedirects(pages []*Page, fileRedirects []Redirect) ([]Redirect, error) {
+	var redirects []Redirect
+	for _, page := range pages {
+		for _, alias := range page.Aliases {
+			redirects = append(redirects, Redirect{
+				From:      path.Clean(alias),
+				To:        page.Path,
+				Source:    page.sourcePath,
+				Permanent: true,
+			})
+		}
+	}
+	redirects = append(redirects, fileRedirects...)
+
+	isPage := make(map[string]bool, len(pages))
+	for _, page := range pages {
+		isPage[path.Clean(page.Path)] = true
+	}
+	declaredAt := make(map[string]string, len(redirects))
+	var errs ErrorList
+	for _, r := range redirects {
+		switch {
+		case isPage[r.From]:
+			errs = append(errs, fmt.Errorf("%s: cannot redirect from %s to %s: there is a page at %s", r.Source, r.From, r.To, r.From))
+		case declaredAt[r.From] != "":
+			errs = append(errs, fmt.Errorf("%s: cannot redirect from %s to %s: there is another redirect from %s (declared in %s)", r.Source, r.From, r.To, r.From, declaredAt[r.From]))
+		default:
+			declaredAt[r.From] = r.Source
+		}
+	}
+	if len(errs) > 0 {
+		return nil, errs
+	}
+	return redirects, nil
+}
+
+//WriteRedirects writes the given redirects into the output directory, in the
+//given formats.
+func WriteRedirects(redirects []Redirect, formats []string, out *OutputDir) error {
+	sorted := append([]Redirect(nil), redirects...)
+	sort.SliceStable(sorted, func(i, j int) bool { return sorted[i].From < sorted[j].From })
+
+	for _, format := range formats {
+		switch format {
+		case RedirectFormatHTML:
+			for _, r := range sorted {
+				err := WriteRedirect(out, r.From, r.To)
+				if err != nil {
+					return err
+				}
+			}
+		case RedirectFormatNetlify:
+			var buf bytes.Buffer
+			for _, r := range sorted {
+				fmt.Fprintf(&buf, "%s %s %d\n", r.From, r.To, r.StatusCode())
+			}
+			err := out.WriteFile(NetlifyRedirectsFileName, buf.Bytes())
+			if err != nil {
+				return err
+			}
+		case RedirectFormatNginx:
+			//usage: map $uri $redirect_target { include nginx-redirects.map; }
+			var permanent, temporary bytes.Buffer
+			for _, r := range sorted {
+				buf := &temporary
+				if r.Permanent {
+					buf = &permanent
+				}
+				fmt.Fprintf(buf, "%s %s;\n", r.From, r.To)
+			}
+			//both files are always written, since nginx fails on a missing include
+			err := out.WriteFile(NginxRedirectsFileName, permanent.Bytes())
+			if err != nil {
+				return err
+			}
+			err = out.WriteFile(NginxTemporaryRedirectsFileName, temporary.Bytes())
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
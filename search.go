@@ -0,0 +1,325 @@
+/*******************************************************************************
+*
+* Copyright 2018 Stefan Majewsky <majewsky@gmx.net>
+*
+* This program is free software: you can redistribute it and/or modify it under
+* the terms of the GNU General Public License as published by the Free Software
+* Foundation, either version 3 of the License, or (at your option) any later
+* version.
+*
+* This program is distributed in the hope that it will be useful, but WITHOUT ANY
+* WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR
+* A PARTICULAR PURPOSE. See the GNU General Public License for more details.
+*
+* You should have received a copy of the GNU General Public License along with
+* this program. If not, see <http://www.gnu.org/licenses/>.
+*
+*******************************************************************************/
+
+package main
+
+import (
+	"encoding/json"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"gitlab.com/golang-commonmark/markdown"
+)
+
+//SearchSection is a part of a page that can be found by the search. Sections
+//are delimited by headings.
+type SearchSection struct {
+	ID      string //corresponds to TOCEntry.ID; empty for text before the first heading
+	Caption string
+	Text    string
+}
+
+//CollectSearchSections takes a parsed Markdown document and its table of
+//contents (as returned by CollectTableOfContents), and extracts the plain text
+//of each section.
+func CollectSearchSections(tokens []markdown.Token, toc []TOCEntry) []SearchSection {
+	sections := []SearchSection{{}}
+	var texts []string
+	headingIdx := 0
+	inHeading := false
+
+	for _, t := range tokens {
+		switch t := t.(type) {
+		case *markdown.HeadingOpen:
+			sections[len(sections)-1].Text = strings.Join(texts, " ")
+			texts = nil
+			sections = append(sections, SearchSection{
+				ID:      toc[headingIdx].ID,
+				Caption: toc[headingIdx].Caption,
+			})
+			headingIdx++
+			inHeading = true
+		case *markdown.HeadingClose:
+			inHeading = false
+		case *markdown.Inline:
+			if !inHeading {
+				texts = append(texts, plainTextOf(t.Children))
+			}
+		case *markdown.CodeBlock:
+			texts = append(texts, t.Content)
+		case *markdown.Fence:
+			//TikZ code is not interesting for readers
+			if t.Params != "tikz" {
+				texts = append(texts, t.Content)
+			}
+		}
+	}
+	sections[len(sections)-1].Text = strings.Join(texts, " ")
+
+	//drop the section before the first heading if it's empty (this is usually
+	//the case when the page starts with its title)
+	if sections[0].Text == "" {
+		sections = sections[1:]
+	}
+	return sections
+}
+
+func plainTextOf(tokens []markdown.Token) string {
+	var texts []string
+	for _, t := range tokens {
+		switch t := t.(type) {
+		case *markdown.Text:
+			texts = append(texts, t.Content)
+		case *markdown.CodeInline:
+			texts = append(texts, t.Content)
+		case *markdown.Image:
+			texts = append(texts, plainTextOf(t.Tokens))
+		case *markdown.Softbreak, *markdown.Hardbreak:
+			texts = append(texts, " ")
+		}
+	}
+	return strings.Join(texts, "")
+}
+
+////////////////////////////////////////////////////////////////////////////////
+// search index
+
+//The search index is an inverted index, i.e. a mapping from search terms to the
+//sections containing them. To keep it small, field names are abbreviated, and
+//sections are referenced by index instead of by ID.
+type searchIndex struct {
+	Pages []searchIndexPage `json:"pages"`
+	//Each value is a flat list of pairs of indexes: [page1, section1, page2, section2, ...].
+	Terms map[string][]int `json:"terms"`
+}
+
+type searchIndexPage struct {
+	URLPath     string      `json:"u"`
+	Title       string      `json:"t"`
+	Description string      `json:"d,omitempty"`
+	Sections    [][2]string `json:"s"` //pairs of ID and caption
+}
+
+//BuildSearchIndex produces the search index for the given pages, in the
+//format understood by the search widget in searchWidgetJS. Pages without
+//sections (e.g. generated listing, status and diff pages) are left out.
+func BuildSearchIndex(pages []*Page) ([]byte, error) {
+	index := searchIndex{Terms: make(map[string][]int)}
+
+	for _, page := range pages {
+		if len(page.searchSections) == 0 {
+			continue
+		}
+		pageIdx := len(index.Pages)
+		ip := searchIndexPage{
+			URLPath:     page.Path,
+			Title:       page.Title,
+			Description: page.Description,
+		}
+		for sectionIdx, section := range page.searchSections {
+			ip.Sections = append(ip.Sections, [2]string{section.ID, section.Caption})
+
+			//the page title and description are considered part of the first section
+			text := section.Caption + " " + section.Text
+			if sectionIdx == 0 {
+				text = page.Title + " " + page.Description + " " + text
+			}
+			isSeen := make(map[string]bool)
+			for _, term := range searchTermsIn(text) {
+				if !isSeen[term] {
+					isSeen[term] = true
+					index.Terms[term] = append(index.Terms[term], pageIdx, sectionIdx)
+				}
+			}
+		}
+		index.Pages = append(index.Pages, ip)
+	}
+
+	return json.Marshal(index)
+}
+
+//Words that are too common to be useful as search terms.
+var searchStopWords = map[string]bool{
+	"a": true, "an": true, "and": true, "are": true, "as": true, "at": true,
+	"be": true, "by": true, "for": true, "from": true, "if": true, "in": true,
+	"is": true, "it": true, "not": true, "of": true, "on": true, "or": true,
+	"that": true, "the": true, "this": true, "to": true, "with": true,
+}
+
+//Splits text into words and reduces them to search terms. This must match
+//the implementation of searchTermsIn() in searchWidgetJS, so lengths are
+//counted in code points (not bytes) and letters and numbers are recognized
+//like \p{L} and \p{N} in JS.
+func searchTermsIn(text string) []string {
+	words := strings.FieldsFunc(strings.ToLower(text), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsNumber(r)
+	})
+	var result []string
+	for _, word := range words {
+		if utf8.RuneCountInString(word) >= 2 && !searchStopWords[word] {
+			result = append(result, stemWord(word))
+		}
+	}
+	return result
+}
+
+//A very simple stemmer for English words. It's not as thorough as a Porter
+//stemmer, but it catches the most common inflections, and it's simple enough
+//to keep the Go and JS implementations in sync.
+func stemWord(w string) string {
+	n := utf8.RuneCountInString(w)
+	switch {
+	case strings.HasSuffix(w, "ies") && n > 4:
+		w = strings.TrimSuffix(w, "ies") + "y"
+	case strings.HasSuffix(w, "sses"):
+		w = strings.TrimSuffix(w, "es")
+	case strings.HasSuffix(w, "ing") && n > 5:
+		w = strings.TrimSuffix(w, "ing")
+	case strings.HasSuffix(w, "ed") && n > 4:
+		w = strings.TrimSuffix(w, "ed")
+	case strings.HasSuffix(w, "s") && n > 3 && !strings.HasSuffix(w, "ss") && !strings.HasSuffix(w, "us") && !strings.HasSuffix(w, "is"):
+		w = strings.TrimSuffix(w, "s")
+	}
+	if strings.HasSuffix(w, "e") && utf8.RuneCountInString(w) > 3 {
+		w = strings.TrimSuffix(w, "e")
+	}
+	return w
+}
+
+////////////////////////////////////////////////////////////////////////////////
+// search widget
+
+//The search widget turns each element with a "data-search" attribute into a
+//search field with a result list. The search index is only loaded when the
+//search field is first used.
+const searchWidgetJS = `(function() {
+  "use strict";
+  var stopWords = {};
+  "a an and are as at be by for from if in is it not of on or that the this to with".split(" ").forEach(function(w) { stopWords[w] = true; });
+
+  //lengths are counted in code points, like utf8.RuneCountInString() in Go
+  function length(w) { return Array.from(w).length; }
+
+  function stemWord(w) {
+    var n = length(w);
+    if (/ies$/.test(w) && n > 4) { w = w.slice(0, -3) + "y"; }
+    else if (/sses$/.test(w)) { w = w.slice(0, -2); }
+    else if (/ing$/.test(w) && n > 5) { w = w.slice(0, -3); }
+    else if (/ed$/.test(w) && n > 4) { w = w.slice(0, -2); }
+    else if (/s$/.test(w) && n > 3 && !/(ss|us|is)$/.test(w)) { w = w.slice(0, -1); }
+    if (/e$/.test(w) && length(w) > 3) { w = w.slice(0, -1); }
+    return w;
+  }
+
+  function searchTermsIn(text) {
+    return text.toLowerCase().split(/[^\p{L}\p{N}]+/u).filter(function(w) {
+      return length(w) >= 2 && !stopWords[w];
+    }).map(stemWord);
+  }
+
+  var index = null;
+  function loadIndex(callback) {
+    if (index) { return callback(); }
+    var req = new XMLHttpRequest();
+    req.open("GET", "/search-index.json");
+    req.onload = function() { index = JSON.parse(req.responseText); callback(); };
+    req.send();
+  }
+
+  //returns all [pageIdx, sectionIdx] pairs that contain all query terms
+  function search(query) {
+    var terms = searchTermsIn(query);
+    if (terms.length == 0) { return []; }
+    var counts = {};
+    terms.forEach(function(term, idx) {
+      //the last term may be incomplete while typing, so match it as a prefix
+      var isPrefix = idx == terms.length - 1;
+      var seen = {};
+      Object.keys(index.terms).forEach(function(t) {
+        if (t == term || (isPrefix && t.indexOf(term) == 0)) {
+          var pairs = index.terms[t];
+          for (var i = 0; i < pairs.length; i += 2) {
+            var key = pairs[i] + "," + pairs[i+1];
+            if (!seen[key]) { seen[key] = true; counts[key] = (counts[key] || 0) + 1; }
+          }
+        }
+      });
+    });
+    return Object.keys(counts).filter(function(key) {
+      return counts[key] == terms.length;
+    }).map(function(key) {
+      return key.split(",").map(Number);
+    }).sort(function(a, b) {
+      return a[0] - b[0] || a[1] - b[1];
+    });
+  }
+
+  function showResults(list, results) {
+    list.innerHTML = "";
+    results.slice(0, 20).forEach(function(r) {
+      var page = index.pages[r[0]];
+      var section = page.s[r[1]];
+      var a = document.createElement("a");
+      a.href = page.u + (section[0] == "" || section[0] == "top" ? "" : "#" + section[0]);
+      a.textContent = page.t + (section[0] == "" || section[0] == "top" ? "" : " › " + section[1]);
+      var li = document.createElement("li");
+      li.appendChild(a);
+      list.appendChild(li);
+    });
+  }
+
+  document.addEventListener("DOMContentLoaded", function() {
+    document.querySelectorAll("[data-search]").forEach(function(container) {
+      var input = document.createElement("input");
+      input.type = "search";
+      input.placeholder = container.getAttribute("data-search") || "Search";
+      var list = document.createElement("ul");
+      list.className = "search-results";
+      container.appendChild(input);
+      container.appendChild(list);
+      input.addEventListener("input", function() {
+        loadIndex(function() { showResults(list, search(input.value)); });
+      });
+    });
+  });
+})();
+`
+
+//Names of the files written by WriteSearchIndex.
+const (
+	SearchIndexFileName  = "search-index.json"
+	SearchWidgetFileName = "search.js"
+)
+
+//WriteSearchIndex writes the search index and the search widget into the
+//output directory. Templates can include the widget with
+//
+//	<div data-search="Search the specs"></div>
+//	<script src="/search.js"></script>
+func WriteSearchIndex(pages []*Page, out *OutputDir) error {
+	buf, err := BuildSearchIndex(pages)
+	if err != nil {
+		return err
+	}
+	err = out.WriteFile(SearchIndexFileName, buf)
+	if err != nil {
+		return err
+	}
+	return out.WriteFile(SearchWidgetFileName, []byte(searchWidgetJS))
+}
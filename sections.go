@@ -0,0 +1,161 @@
+/*******************************************************************************
+*
+* Copyright 2018 Stefan Majewsky <majewsky@gmx.net>
+*
+* This program is free software: you can redistribute it and/or modify it under
+* the terms of the GNU General Public License as published by the Free Software
+* Foundation, either version 3 of the License, or (at your option) any later
+* version.
+*
+* This program is distributed in the hope that it will be useful, but WITHOUT ANY
+* WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR
+* A PARTICULAR PURPOSE. See the GNU General Public License for more details.
+*
+* You should have received a copy of the GNU General Public License along with
+* this program. If not, see <http://www.gnu.org/licenses/>.
+*
+*******************************************************************************/
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+
+	"gitlab.com/golang-commonmark/markdown"
+)
+
+//Section numbering modes, see Config.SectionNumbers.
+const (
+	SectionNumbersManual = "manual"
+	SectionNumbersAuto   = "auto"
+)
+
+//A section number like "3.2." is stored as []int{3, 2}.
+type sectionNumber []int
+
+func parseSectionNumber(caption string) sectionNumber {
+	match := sectionNumberRx.FindStringSubmatch(strings.TrimSpace(caption))
+	if match == nil {
+		return nil
+	}
+	var result sectionNumber
+	for _, field := range strings.Split(strings.TrimSuffix(match[1], "."), ".") {
+		n, _ := strconv.Atoi(field) //cannot fail because of the regex
+		result = append(result, n)
+	}
+	return result
+}
+
+func (n sectionNumber) String() string {
+	var buf strings.Builder
+	for _, component := range n {
+		fmt.Fprintf(&buf, "%d.", component)
+	}
+	return buf.String()
+}
+
+//LintSectionNumbers checks that the manual section numbers in the given TOC
+//(e.g. "3.2." in "## 3.2. Message format") are sequential, without gaps or
+//duplicates, and that their depth matches the heading level (i.e. "3." is an
+//<h2>, "3.2." is an <h3>, and so on). Headings without section numbers are
+//ignored.
+func LintSectionNumbers(sourcePath string, toc []TOCEntry) []error {
+	var (
+		errs   []error
+		last   sectionNumber
+		isSeen = make(map[string]bool)
+	)
+	for _, e := range toc {
+		n := parseSectionNumber(e.Caption)
+		if n == nil {
+			continue
+		}
+		report := func(msg string, args ...interface{}) {
+			errs = append(errs, fmt.Errorf("%s:%d: section %s %s", sourcePath, e.line, n, fmt.Sprintf(msg, args...)))
+		}
+
+		if len(n) != e.Level {
+			report("is in an <h%d>, but should be in an <h%d>", e.Level+1, len(n)+1)
+		}
+		switch expected := last.next(len(n)); {
+		case isSeen[n.String()]:
+			report("appears more than once")
+		case expected == nil && last == nil:
+			report("skips a level")
+		case expected == nil:
+			report("skips a level after section %s", last)
+		case n.String() != expected.String():
+			if last == nil {
+				report("should be section %s", expected)
+			} else {
+				report("follows section %s, should be section %s", last, expected)
+			}
+		}
+
+		isSeen[n.String()] = true
+		last = n
+	}
+	return errs
+}
+
+//Returns the section number that should follow this one at the given depth,
+//e.g. "3.2." is followed by "3.3." at depth 2, by "4." at depth 1, and by
+//"3.2.1." at depth 3. Returns nil if the depth skips a level.
+func (n sectionNumber) next(depth int) sectionNumber {
+	switch {
+	case depth <= len(n):
+		result := append(sectionNumber(nil), n[:depth]...)
+		result[depth-1]++
+		return result
+	case depth == len(n)+1:
+		return append(append(sectionNumber(nil), n...), 1)
+	default:
+		return nil
+	}
+}
+
+//NumberSections adds section numbers to all headings below <h1>, e.g. "3."
+//to an <h2> and "3.2." to an <h3>. This must be done before the TOC is
+//collected, so that the numbers are reflected in the heading IDs.
+func NumberSections(sourcePath string, tokens []markdown.Token) {
+	var (
+		current sectionNumber
+		depth   int
+	)
+	for _, t := range tokens {
+		switch t := t.(type) {
+		case *markdown.HeadingOpen:
+			depth = t.HLevel - 1
+			if depth == 0 {
+				continue
+			}
+			next := current.next(depth)
+			if next == nil {
+				fmt.Fprintf(os.Stderr, "WARNING: %s:%d: heading skips a level\n", sourcePath, t.Map[0]+1)
+				//fill in the missing levels
+				next = append(sectionNumber(nil), current...)
+				for len(next) < depth {
+					next = append(next, 1)
+				}
+			}
+			current = next
+
+		case *markdown.HeadingClose:
+			depth = 0
+
+		case *markdown.Inline:
+			if depth == 0 {
+				continue
+			}
+			if parseSectionNumber(t.Content) != nil {
+				fmt.Fprintf(os.Stderr, "WARNING: %s:%d: heading already has a section number\n", sourcePath, t.Map[0]+1)
+			}
+			prefix := current.String() + " "
+			t.Content = prefix + t.Content
+			t.Children = append([]markdown.Token{&markdown.Text{Content: prefix}}, t.Children...)
+		}
+	}
+}
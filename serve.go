@@ -0,0 +1,161 @@
+/*******************************************************************************
+*
+* Copyright 2018 Stefan Majewsky <majewsky@gmx.net>
+*
+* This program is free software: you can redistribute it and/or modify it under
+* the terms of the GNU General Public License as published by the Free Software
+* Foundation, either version 3 of the License, or (at your option) any later
+* version.
+*
+* This program is distributed in the hope that it will be useful, but WITHOUT ANY
+* WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR
+* A PARTICULAR PURPOSE. See the GNU General Public License for more details.
+*
+* You should have received a copy of the GNU General Public License along with
+* this program. If not, see <http://www.gnu.org/licenses/>.
+*
+*******************************************************************************/
+
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+//The URL path where browsers listen for reload events.
+const liveReloadPath = "/_livereload"
+
+//This gets injected into every HTML page delivered by Serve().
+const liveReloadScript = `<script>new EventSource("` + liveReloadPath + `").onmessage = function() { location.reload(); };</script>`
+
+//Serve runs a HTTP server on the given address that delivers the output
+//directory of the given Builder, and rebuilds it whenever input files change.
+//Browsers are told to reload the page after each rebuild. Serve only returns
+//if the HTTP server fails.
+func Serve(b *Builder, listenAddress string) error {
+	reloader := &liveReloader{clients: make(map[chan struct{}]bool)}
+	go Watch(b, reloader.Notify)
+
+	mux := http.NewServeMux()
+	mux.Handle(liveReloadPath, reloader)
+	mux.Handle("/", outputDirHandler{b.OutputDir, http.FileServer(http.Dir(b.OutputDir))})
+	return http.ListenAndServe(listenAddress, mux)
+}
+
+////////////////////////////////////////////////////////////////////////////////
+// type outputDirHandler
+
+//Serves files from the output directory, but injects the live-reload script
+//into each HTML page on the way.
+type outputDirHandler struct {
+	OutputDir  string
+	FileServer http.Handler
+}
+
+//ServeHTTP implements the http.Handler interface.
+func (h outputDirHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	//find the file that the http.FileServer would deliver (page paths like
+	///std/core/1.0 are directories containing an index.html as written by
+	//Page.WriteTo())
+	urlPath := path.Clean("/" + r.URL.Path)
+	fsPath := filepath.Join(h.OutputDir, filepath.FromSlash(urlPath))
+	fi, err := os.Stat(fsPath)
+	if err == nil && fi.IsDir() {
+		//for directories without trailing slash, http.FileServer redirects to
+		//the URL with trailing slash; let it do that
+		if !strings.HasSuffix(r.URL.Path, "/") {
+			h.FileServer.ServeHTTP(w, r)
+			return
+		}
+		fsPath = filepath.Join(fsPath, "index.html")
+	}
+	if !strings.HasSuffix(fsPath, ".html") {
+		h.FileServer.ServeHTTP(w, r)
+		return
+	}
+	content, err := ioutil.ReadFile(fsPath)
+	if err != nil {
+		//let http.FileServer generate the appropriate error response
+		h.FileServer.ServeHTTP(w, r)
+		return
+	}
+
+	//put the script at the end of the body if possible, or at the end of the document otherwise
+	idx := bytes.LastIndex(content, []byte("</body>"))
+	if idx == -1 {
+		idx = len(content)
+	}
+	var buf bytes.Buffer
+	buf.Write(content[:idx])
+	buf.WriteString(liveReloadScript)
+	buf.Write(content[idx:])
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(http.StatusOK)
+	w.Write(buf.Bytes())
+}
+
+////////////////////////////////////////////////////////////////////////////////
+// type liveReloader
+
+//Delivers reload events to browsers as a stream of server-sent events.
+type liveReloader struct {
+	mutex   sync.Mutex
+	clients map[chan struct{}]bool
+}
+
+//Notify tells all connected browsers to reload.
+func (lr *liveReloader) Notify() {
+	lr.mutex.Lock()
+	defer lr.mutex.Unlock()
+	for client := range lr.clients {
+		//channels are buffered, so if there's already an event pending, we
+		//don't need to send another one
+		select {
+		case client <- struct{}{}:
+		default:
+		}
+	}
+}
+
+//ServeHTTP implements the http.Handler interface.
+func (lr *liveReloader) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming not supported", http.StatusInternalServerError)
+		return
+	}
+
+	client := make(chan struct{}, 1)
+	lr.mutex.Lock()
+	lr.clients[client] = true
+	lr.mutex.Unlock()
+	defer func() {
+		lr.mutex.Lock()
+		delete(lr.clients, client)
+		lr.mutex.Unlock()
+	}()
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	for {
+		select {
+		case <-client:
+			w.Write([]byte("data: reload\n\n"))
+			flusher.Flush()
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
@@ -0,0 +1,90 @@
+/*******************************************************************************
+*
+* Copyright 2018 Stefan Majewsky <majewsky@gmx.net>
+*
+* This program is free software: you can redistribute it and/or modify it under
+* the terms of the GNU General Public License as published by the Free Software
+* Foundation, either version 3 of the License, or (at your option) any later
+* version.
+*
+* This program is distributed in the hope that it will be useful, but WITHOUT ANY
+* WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR
+* A PARTICULAR PURPOSE. See the GNU General Public License for more details.
+*
+* You should have received a copy of the GNU General Public License along with
+* this program. If not, see <http://www.gnu.org/licenses/>.
+*
+*******************************************************************************/
+
+package main
+
+import (
+	"bytes"
+	"encoding/xml"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+//Names of the files written by WriteSitemap.
+const (
+	SitemapFileName   = "sitemap.xml"
+	RobotsTxtFileName = "robots.txt"
+)
+
+type sitemapURLSet struct {
+	XMLName xml.Name     `xml:"http://www.sitemaps.org/schemas/sitemap/0.9 urlset"`
+	URLs    []sitemapURL `xml:"url"`
+}
+
+type sitemapURL struct {
+	Location     string `xml:"loc"`
+	LastModified string `xml:"lastmod,omitempty"`
+}
+
+//WriteSitemap writes sitemap.xml and robots.txt into the output directory.
+//Draft pages are not included in the sitemap. If the static assets contain a
+//robots.txt, it is used instead of the generated one.
+func WriteSitemap(pages []*Page, cfg Config, out *OutputDir) error {
+	baseURL := strings.TrimSuffix(cfg.BaseURL, "/")
+
+	var urlSet sitemapURLSet
+	for _, page := range pages {
+		if page.IsDraft {
+			continue
+		}
+		u := sitemapURL{Location: baseURL + page.Path}
+		if !page.LastModified.IsZero() {
+			u.LastModified = page.LastModified.UTC().Format(time.RFC3339)
+		}
+		urlSet.URLs = append(urlSet.URLs, u)
+	}
+	sort.SliceStable(urlSet.URLs, func(i, j int) bool {
+		return urlSet.URLs[i].Location < urlSet.URLs[j].Location
+	})
+
+	var buf bytes.Buffer
+	buf.WriteString(xml.Header)
+	enc := xml.NewEncoder(&buf)
+	enc.Indent("", "  ")
+	err := enc.Encode(urlSet)
+	if err != nil {
+		return err
+	}
+	buf.WriteByte('\n')
+	err = out.WriteFile(SitemapFileName, buf.Bytes())
+	if err != nil {
+		return err
+	}
+
+	robotsTxt, err := ioutil.ReadFile(filepath.Join(cfg.InputPath(cfg.StaticDir), RobotsTxtFileName))
+	if os.IsNotExist(err) {
+		robotsTxt = []byte("User-agent: *\nAllow: /\n\nSitemap: " + baseURL + "/" + SitemapFileName + "\n")
+	} else if err != nil {
+		return err
+	}
+	return out.WriteFile(RobotsTxtFileName, robotsTxt)
+}
@@ -22,7 +22,6 @@ import (
 	"bytes"
 	"crypto/md5"
 	"encoding/hex"
-	"encoding/json"
 	"errors"
 	"fmt"
 	"html"
@@ -30,9 +29,11 @@ import (
 	"io/ioutil"
 	"os"
 	"os/exec"
+	"path"
 	"path/filepath"
 	"regexp"
 	"strings"
+	"time"
 
 	"gitlab.com/golang-commonmark/markdown"
 )
@@ -44,21 +45,21 @@ type SourceFile struct {
 }
 
 //FindSourceFiles discovers all source files in the input directory.
-func FindSourceFiles(inputDir string) ([]SourceFile, error) {
+func FindSourceFiles(cfg Config) ([]SourceFile, error) {
 	var result []SourceFile
 
-	baseDir := filepath.Join(inputDir, "spec")
+	baseDir := cfg.InputPath(cfg.SpecDir)
 	err := walk(baseDir, func(path string, fi os.FileInfo) {
 		if fi.Mode().IsRegular() && strings.HasSuffix(path, ".md") {
 			relativePath, _ := filepath.Rel(baseDir, path)
-			result = append(result, newSourceFile(path, filepath.Join("std", relativePath)))
+			result = append(result, newSourceFile(path, filepath.Join(cfg.SpecURLPrefix, relativePath)))
 		}
 	})
 	if err != nil {
 		return nil, err
 	}
 
-	baseDir = filepath.Join(inputDir, "website/pages")
+	baseDir = cfg.InputPath(cfg.PagesDir)
 	err = walk(baseDir, func(path string, fi os.FileInfo) {
 		if fi.Mode().IsRegular() && strings.HasSuffix(path, ".md") {
 			relativePath, _ := filepath.Rel(baseDir, path)
@@ -86,7 +87,7 @@ func walk(root string, callback func(string, os.FileInfo)) error {
 //Called by FindSourceFiles().
 func newSourceFile(path, relativePath string) SourceFile {
 	//e.g.        path = "/path/to/vt6/spec/core/1.0.md"
-	//and relativePath = "std/core/1.0.md" ("std" was added above already)
+	//and relativePath = "std/core/1.0.md" (Config.SpecURLPrefix was added above already)
 
 	//strip the ".md" suffix from the URL
 	urlPath := strings.TrimSuffix(relativePath, ".md")
@@ -107,26 +108,53 @@ func newSourceFile(path, relativePath string) SourceFile {
 	}
 }
 
+//Matches the start of a paragraph starting with *Rationale:*. The paragraph
+//may have an ID (see PermalinkOptions).
+var rationaleRx = regexp.MustCompile(`\n<p( id="[^"]*")?><em>Rationale:</em>`)
+
 //Render converts the Markdown from the source file to HTML and initializes a
-//Page instance for this source file.
-func (s SourceFile) Render() (Page, error) {
+//Page instance for this source file. TikZ pictures are looked up in and added
+//to the given cache (which may be nil). The anchor manifest from the previous
+//build is used to find aliases for headings whose ID changed.
+func (s SourceFile) Render(cfg Config, tikzCache *TikzCache, anchors AnchorManifest) (Page, error) {
 	contentBytes, err := ioutil.ReadFile(s.FilesystemPath)
 	if err != nil {
 		return Page{}, err
 	}
+	fm, contentBytes, err := ParseFrontMatter(s.FilesystemPath, contentBytes)
+	if err != nil {
+		return Page{}, err
+	}
 	md := markdown.New(markdown.HTML(true))
 	tokens := md.Parse(contentBytes)
-	toc := CollectTableOfContents(tokens)
+	sectionNumbers := cfg.SectionNumbers
+	if fm.SectionNumbers != "" {
+		sectionNumbers = fm.SectionNumbers
+	}
+	if sectionNumbers == SectionNumbersAuto {
+		NumberSections(s.FilesystemPath, tokens)
+	}
+	toc := CollectTableOfContents(s.FilesystemPath, tokens)
+	if sectionNumbers == SectionNumbersManual {
+		for _, err := range LintSectionNumbers(s.FilesystemPath, toc) {
+			fmt.Fprintln(os.Stderr, "WARNING: "+err.Error())
+		}
+	}
+	searchSections := CollectSearchSections(tokens, toc)
+	sourceLinks := collectSourceLinks(tokens)
+	err = AddAnchorAliases(s.FilesystemPath, s.URLPath, toc, fm.AnchorAliases, anchors)
+	if err != nil {
+		return Page{}, err
+	}
+	//add link targets to headings
+	tokens, err = AddTargetsToHeadings(s.FilesystemPath, tokens, toc, cfg.PermalinkOptions())
+	if err != nil {
+		return Page{}, err
+	}
 	contentHTML := md.RenderTokensToString(tokens)
 
 	//recognize paragraphs starting with *Rationale:*
-	contentHTML = strings.Replace(contentHTML,
-		"\n<p><em>Rationale:</em>",
-		"\n<p class=\"rationale\"><em>Rationale:</em>",
-		-1,
-	)
-	//add link targets to headings
-	contentHTML = InjectTargetsIntoHeadings(contentHTML, toc)
+	contentHTML = rationaleRx.ReplaceAllString(contentHTML, "\n<p$1 class=\"rationale\"><em>Rationale:</em>")
 
 	//compile TikZ code into SVGs
 	tikzOpening := `<pre><code class="language-tikz">`
@@ -138,7 +166,7 @@ func (s SourceFile) Render() (Page, error) {
 		match = strings.TrimPrefix(match, tikzOpening)
 		match = strings.TrimSuffix(match, tikzClosing)
 		match = html.UnescapeString(match)
-		asset, err2 := compileTikzPicture(match)
+		asset, err2 := compileTikzPicture(match, cfg.SVGOutputDir, tikzCache)
 		if err == nil {
 			err = err2
 		}
@@ -152,41 +180,8 @@ func (s SourceFile) Render() (Page, error) {
 		return Page{}, err
 	}
 
-	//recognize draft marker ...
-	fields := strings.SplitN(contentHTML, "\n", 2)
-	firstLine := fields[0]
-	isDraft := strings.TrimSpace(firstLine) == "<!-- draft -->"
-	//... and remove it
-	if isDraft {
-		contentHTML = fields[1]
-	}
-
-	//recognize explicit title/description declaration...
-	fields = strings.SplitN(contentHTML, "\n", 2)
-	firstLine = fields[0]
-	match := regexp.MustCompile(`^<!--\s*(\{.*\})\s*-->$`).FindStringSubmatch(firstLine)
-	title, description := "", ""
-	if match != nil {
-		//...parse it...
-		var data struct {
-			Title       string `json:"title"`
-			Description string `json:"description"`
-		}
-		err := json.Unmarshal([]byte(match[1]), &data)
-		if err != nil {
-			return Page{}, fmt.Errorf(
-				"read %s: unmarshal front matter failed: %s",
-				s.FilesystemPath, err.Error(),
-			)
-		}
-		title = data.Title
-		description = data.Description
-
-		//... and remove it
-		contentHTML = fields[1]
-	}
-
-	//find page title, usually from leading heading
+	//find page title, usually from leading heading (unless given in the front matter)
+	title, description := fm.Title, fm.Description
 	if title == "" {
 		if len(toc) > 0 && toc[0].IsPageTitle {
 			title = toc[0].Caption
@@ -195,7 +190,9 @@ func (s SourceFile) Render() (Page, error) {
 			fields := strings.SplitN(title, " - ", 2)
 			if len(fields) == 2 {
 				title = fields[0]
-				description = fields[1]
+				if description == "" {
+					description = fields[1]
+				}
 			}
 		} else {
 			//last-resort fallback
@@ -204,21 +201,93 @@ func (s SourceFile) Render() (Page, error) {
 		}
 	}
 
+	//build table of contents, as configured site-wide and in the front matter
+	var tocItems []*TOCItem
+	if fm.TOC == nil || *fm.TOC {
+		minLevel, maxLevel := cfg.TOCMinLevel, cfg.TOCMaxLevel
+		if fm.TOCMinLevel != 0 {
+			minLevel = fm.TOCMinLevel
+		}
+		if fm.TOCMaxLevel != 0 {
+			maxLevel = fm.TOCMaxLevel
+		}
+		//the front matter may set only one of the levels, so this can only be
+		//checked after merging with the site-wide config
+		if minLevel > maxLevel {
+			return Page{}, fmt.Errorf("%s: toc_min_level (%d) may not be greater than toc_max_level (%d)", s.FilesystemPath, minLevel, maxLevel)
+		}
+		tocItems = BuildTableOfContents(toc, minLevel, maxLevel)
+	}
+
+	//the draft marker and the draft status mean the same thing
+	status := fm.Status
+	if fm.IsDraft && status == "" {
+		status = StatusDraft
+	}
+
 	return Page{
 		Path:                s.URLPath,
 		Title:               title,
 		Description:         description,
-		IsDraft:             isDraft,
+		IsDraft:             fm.IsDraft || status == StatusDraft,
+		Status:              status,
+		Version:             fm.Version,
+		Authors:             fm.Authors,
+		Date:                fm.Date.Time,
+		Weight:              fm.Weight,
+		Aliases:             fm.Aliases,
+		Tags:                fm.Tags,
+		Template:            fm.Template,
+		NavLabel:            fm.NavLabel,
+		Params:              fm.Params,
+		LastModified:        s.lastModified(),
 		ContentHTML:         template.HTML(contentHTML),
-		TableOfContentsHTML: template.HTML(RenderTableOfContents(toc)),
+		TableOfContents:     tocItems,
+		TableOfContentsHTML: template.HTML(RenderTableOfContents(tocItems)),
 		Assets:              assets,
+		sourcePath:          s.FilesystemPath,
+		sourceURLPath:       s.URLPath,
+		toc:                 toc,
+		searchSections:      searchSections,
+		sourceLinks:         sourceLinks,
+		supersededByPath:    fm.SupersededBy,
+		replacesPaths:       fm.Replaces,
+		markdownSource:      contentBytes,
 	}, nil
 }
 
-//Takes in some LaTeX/TikZ source code and returns the rendered SVG.
-func compileTikzPicture(code string) (asset Asset, returnErr error) {
+//Returns when the source file was last changed, preferably according to the
+//Git history. For files that are not in a Git repository, or not committed
+//yet, the mtime is used instead.
+func (s SourceFile) lastModified() time.Time {
+	cmd := exec.Command("git", "log", "-1", "--format=%cI", "--", filepath.Base(s.FilesystemPath))
+	cmd.Dir = filepath.Dir(s.FilesystemPath)
+	out, err := cmd.Output()
+	if err == nil {
+		t, err := time.Parse(time.RFC3339, strings.TrimSpace(string(out)))
+		if err == nil {
+			return t
+		}
+	}
+
+	fi, err := os.Stat(s.FilesystemPath)
+	if err != nil {
+		return time.Time{}
+	}
+	return fi.ModTime()
+}
+
+//Takes in some LaTeX/TikZ source code and returns the rendered SVG, to be
+//placed in the given output directory.
+func compileTikzPicture(code, svgDir string, tikzCache *TikzCache) (asset Asset, returnErr error) {
 	pictureHash := md5.Sum([]byte(code))
 	pictureID := hex.EncodeToString(pictureHash[:])
+	assetPath := path.Join(filepath.ToSlash(svgDir), pictureID+".svg")
+
+	content, exists := tikzCache.Get(pictureID)
+	if exists {
+		return Asset{Path: assetPath, Content: content}, nil
+	}
 
 	//split preamble from drawing code
 	fields := regexp.MustCompile(`(?m)^---\s*$`).Split(code, 2)
@@ -228,12 +297,9 @@ func compileTikzPicture(code string) (asset Asset, returnErr error) {
 	preamble := strings.TrimSpace(fields[0])
 	drawingCode := strings.TrimSpace(fields[1])
 
-	//create temp directory for compilation
-	tempDir := filepath.Join(
-		os.TempDir(),
-		"vt6-website-build-"+pictureID,
-	)
-	err := os.MkdirAll(tempDir, 0700)
+	//create temp directory for compilation (the name must be unique since the
+	//same picture might be compiled for multiple pages at once)
+	tempDir, err := ioutil.TempDir("", "vt6-website-build-"+pictureID+"-")
 	if err != nil {
 		return Asset{}, err
 	}
@@ -274,5 +340,9 @@ func compileTikzPicture(code string) (asset Asset, returnErr error) {
 	if err != nil {
 		return Asset{}, fmt.Errorf("exec pdflatex failed: %s", err.Error())
 	}
-	return Asset{Path: "svg/" + pictureID + ".svg", Content: buf.Bytes()}, nil
+	err = tikzCache.Put(pictureID, buf.Bytes())
+	if err != nil {
+		return Asset{}, err
+	}
+	return Asset{Path: assetPath, Content: buf.Bytes()}, nil
 }
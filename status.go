@@ -0,0 +1,179 @@
+/*******************************************************************************
+*
+* Copyright 2018 Stefan Majewsky <majewsky@gmx.net>
+*
+* This program is free software: you can redistribute it and/or modify it under
+* the terms of the GNU General Public License as published by the Free Software
+* Foundation, either version 3 of the License, or (at your option) any later
+* version.
+*
+* This program is distributed in the hope that it will be useful, but WITHOUT ANY
+* WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR
+* A PARTICULAR PURPOSE. See the GNU General Public License for more details.
+*
+* You should have received a copy of the GNU General Public License along with
+* this program. If not, see <http://www.gnu.org/licenses/>.
+*
+*******************************************************************************/
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"html/template"
+	"path"
+	"sort"
+	"strings"
+)
+
+//Values for the "status" key in the front matter.
+const (
+	StatusDraft      = "draft"
+	StatusProposed   = "proposed"
+	StatusStable     = "stable"
+	StatusDeprecated = "deprecated"
+	StatusSuperseded = "superseded"
+)
+
+var allStatuses = []string{StatusDraft, StatusProposed, StatusStable, StatusDeprecated, StatusSuperseded}
+
+//Checks the "status", "superseded_by" and "replaces" keys of the front matter.
+//Whether the link targets exist is checked later by ResolveStatusLinks.
+func (fm FrontMatter) validateStatus(sourcePath string) []error {
+	var errs []error
+	if fm.Status != "" {
+		err := validateOneOf(allStatuses...)(fm.Status)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s: status %s, got %q", sourcePath, err.Error(), fm.Status))
+		}
+	}
+	if fm.IsDraft && fm.Status != "" && fm.Status != StatusDraft {
+		errs = append(errs, fmt.Errorf("%s: pages with the draft marker must have status %q, got %q", sourcePath, StatusDraft, fm.Status))
+	}
+	switch {
+	case fm.Status == StatusSuperseded && fm.SupersededBy == "":
+		errs = append(errs, fmt.Errorf("%s: status %q requires superseded_by", sourcePath, fm.Status))
+	case fm.Status != StatusSuperseded && fm.SupersededBy != "":
+		errs = append(errs, fmt.Errorf("%s: superseded_by requires status %q", sourcePath, StatusSuperseded))
+	}
+	for _, target := range append([]string{fm.SupersededBy}, fm.Replaces...) {
+		if target != "" && !strings.HasPrefix(target, "/") {
+			errs = append(errs, fmt.Errorf("%s: %q in superseded_by or replaces must be an absolute URL path", sourcePath, target))
+		}
+	}
+	return errs
+}
+
+//ResolveStatusLinks fills Page.SupersededBy and Page.Replaces from the paths
+//given in the front matter. An error is returned if any of these paths does
+//not refer to a page in the given NavigationTree.
+func (p *Page) ResolveStatusLinks(root *NavigationTree) error {
+	resolve := func(key, urlPath string) (NavigationLink, error) {
+		node := ntLocate(root, path.Clean(urlPath), false)
+		if node == nil || !node.Exists {
+			return NavigationLink{}, fmt.Errorf("%s: %s refers to %s, but there is no such page", p.sourcePath, key, urlPath)
+		}
+		return node.Link(), nil
+	}
+
+	p.SupersededBy = nil
+	if p.supersededByPath != "" {
+		link, err := resolve("superseded_by", p.supersededByPath)
+		if err != nil {
+			return err
+		}
+		p.SupersededBy = &link
+	}
+
+	p.Replaces = nil
+	for _, urlPath := range p.replacesPaths {
+		link, err := resolve("replaces", urlPath)
+		if err != nil {
+			return err
+		}
+		p.Replaces = append(p.Replaces, link)
+	}
+	return nil
+}
+
+//An entry on the status overview page.
+type statusRow struct {
+	Module       string
+	Version      string
+	URLPath      string
+	Title        string
+	Status       string
+	SupersededBy string
+}
+
+var statusContentTemplate = template.Must(template.New("status").Parse(
+	`<h1>Status of all modules</h1>
+<table class="status">
+<thead><tr><th>Module</th><th>Version</th><th>Title</th><th>Status</th></tr></thead>
+<tbody>{{range .}}
+<tr class="status-{{or .Status "unknown"}}"><td>{{.Module}}</td><td><a href="{{.URLPath}}">{{.Version}}</a></td><td>{{.Title}}</td><td>{{or .Status "unknown"}}{{with .SupersededBy}} (by <a href="{{.}}">{{.}}</a>){{end}}</td></tr>{{end}}
+</tbody>
+</table>`))
+
+//GenerateStatusPage creates the page at "/<spec_url_prefix>/status" that lists
+//all spec modules with their versions and statuses. Returns nil if there are
+//no specs, or if there is a source file for this page already.
+func GenerateStatusPage(pages []*Page, cfg Config) (*Page, error) {
+	prefix := path.Join("/", cfg.SpecURLPrefix)
+	statusPath := path.Join(prefix, "status")
+
+	var rows []statusRow
+	for _, page := range pages {
+		if page.Path == statusPath {
+			return nil, nil
+		}
+		if !strings.HasPrefix(page.Path, prefix+"/") {
+			continue
+		}
+		//e.g. "/std/core/1.0" -> module "core", version "1.0"
+		relPath := strings.TrimPrefix(page.Path, prefix+"/")
+		row := statusRow{
+			Module:       relPath,
+			Version:      page.Version,
+			URLPath:      page.Path,
+			Title:        page.Title,
+			Status:       page.Status,
+			SupersededBy: page.supersededByPath,
+		}
+		if idx := strings.LastIndex(relPath, "/"); idx >= 0 {
+			row.Module = relPath[:idx]
+			if row.Version == "" {
+				row.Version = relPath[idx+1:]
+			}
+		}
+		rows = append(rows, row)
+	}
+	if len(rows) == 0 {
+		return nil, nil
+	}
+	sort.SliceStable(rows, func(i, j int) bool {
+		if rows[i].Module != rows[j].Module {
+			return naturalLess(rows[i].Module, rows[j].Module)
+		}
+		return naturalLess(rows[i].Version, rows[j].Version)
+	})
+
+	var buf bytes.Buffer
+	err := statusContentTemplate.Execute(&buf, rows)
+	if err != nil {
+		return nil, err
+	}
+	page := &Page{
+		Path:        statusPath,
+		Title:       "Status of all modules",
+		ContentHTML: template.HTML(buf.String()),
+		generatedBy: "GenerateStatusPage",
+	}
+	for _, p := range pages {
+		if p.LastModified.After(page.LastModified) {
+			page.LastModified = p.LastModified
+		}
+	}
+	return page, nil
+}
@@ -0,0 +1,202 @@
+/*******************************************************************************
+*
+* Copyright 2018 Stefan Majewsky <majewsky@gmx.net>
+*
+* This program is free software: you can redistribute it and/or modify it under
+* the terms of the GNU General Public License as published by the Free Software
+* Foundation, either version 3 of the License, or (at your option) any later
+* version.
+*
+* This program is distributed in the hope that it will be useful, but WITHOUT ANY
+* WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR
+* A PARTICULAR PURPOSE. See the GNU General Public License for more details.
+*
+* You should have received a copy of the GNU General Public License along with
+* this program. If not, see <http://www.gnu.org/licenses/>.
+*
+*******************************************************************************/
+
+package main
+
+import (
+	"crypto/md5"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"sync"
+)
+
+//TikzCache is an on-disk cache for SVGs compiled from TikZ pictures. A nil
+//*TikzCache is valid and behaves like a cache that never hits. All methods are
+//safe for concurrent use.
+type TikzCache struct {
+	Dir string
+
+	mutex       sync.Mutex
+	toolchainID string //empty if not determined yet
+	used        map[string]bool
+	hits        int
+	misses      int
+}
+
+//Matches the filenames of cache entries, see TikzCache.entryName().
+var tikzCacheEntryRx = regexp.MustCompile(`^[0-9a-f]{32}-[0-9a-f]{32}\.svg$`)
+
+//NewTikzCache initializes a TikzCache in the given directory. If `dir` is
+//empty, nil is returned, thus disabling the cache.
+func NewTikzCache(dir string) (*TikzCache, error) {
+	if dir == "" {
+		return nil, nil
+	}
+	err := os.MkdirAll(dir, 0777)
+	if err != nil {
+		return nil, err
+	}
+	return &TikzCache{Dir: dir, used: make(map[string]bool)}, nil
+}
+
+//Get returns the cached SVG for the given picture ID (as computed by
+//compileTikzPicture()), or false if there is no such cache entry.
+func (tc *TikzCache) Get(pictureID string) ([]byte, bool) {
+	if tc == nil {
+		return nil, false
+	}
+	tc.mutex.Lock()
+	defer tc.mutex.Unlock()
+
+	name, err := tc.entryName(pictureID)
+	if err != nil {
+		tc.misses++
+		return nil, false
+	}
+	tc.used[name] = true
+
+	content, err := ioutil.ReadFile(filepath.Join(tc.Dir, name))
+	if err != nil {
+		tc.misses++
+		return nil, false
+	}
+	tc.hits++
+	return content, true
+}
+
+//Put stores a freshly compiled SVG in the cache.
+func (tc *TikzCache) Put(pictureID string, content []byte) error {
+	if tc == nil {
+		return nil
+	}
+	tc.mutex.Lock()
+	name, err := tc.entryName(pictureID)
+	if err == nil {
+		tc.used[name] = true
+	}
+	tc.mutex.Unlock()
+	if err != nil {
+		return err
+	}
+
+	//write into a temporary file first, so that an interrupted build does not
+	//leave a broken cache entry behind
+	tmpFile, err := ioutil.TempFile(tc.Dir, ".tmp-")
+	if err != nil {
+		return err
+	}
+	_, err = tmpFile.Write(content)
+	if err == nil {
+		err = tmpFile.Close()
+	} else {
+		tmpFile.Close()
+	}
+	if err == nil {
+		err = os.Rename(tmpFile.Name(), filepath.Join(tc.Dir, name))
+	}
+	if err != nil {
+		os.Remove(tmpFile.Name())
+	}
+	return err
+}
+
+//Reset forgets which cache entries were used, and resets the hit/miss
+//counters. This is called at the start of each full build.
+func (tc *TikzCache) Reset() {
+	if tc == nil {
+		return
+	}
+	tc.mutex.Lock()
+	defer tc.mutex.Unlock()
+	tc.used = make(map[string]bool)
+	tc.hits = 0
+	tc.misses = 0
+}
+
+//EvictUnused removes all cache entries that were not used since the last
+//Reset(). This must only be called at the end of a full build, otherwise we
+//would evict entries for pages that were not rendered.
+func (tc *TikzCache) EvictUnused() error {
+	if tc == nil {
+		return nil
+	}
+	tc.mutex.Lock()
+	defer tc.mutex.Unlock()
+
+	fis, err := ioutil.ReadDir(tc.Dir)
+	if err != nil {
+		return err
+	}
+	for _, fi := range fis {
+		name := fi.Name()
+		//leave files alone that we did not create
+		if !tikzCacheEntryRx.MatchString(name) || tc.used[name] {
+			continue
+		}
+		err := os.Remove(filepath.Join(tc.Dir, name))
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+//ReportStats prints the hit/miss counts on stderr.
+func (tc *TikzCache) ReportStats() {
+	if tc == nil {
+		return
+	}
+	tc.mutex.Lock()
+	defer tc.mutex.Unlock()
+	if tc.hits+tc.misses == 0 {
+		return
+	}
+	fmt.Fprintf(os.Stderr, "TikZ cache: %d hits, %d misses\n", tc.hits, tc.misses)
+}
+
+//Cache entries are keyed by the picture ID and the toolchain version, since
+//different versions of pdflatex or pdf2svg might render the same picture
+//differently. The caller must hold tc.mutex.
+func (tc *TikzCache) entryName(pictureID string) (string, error) {
+	if tc.toolchainID == "" {
+		//pdflatex tells us its version and the version of the TeX distribution;
+		//pdf2svg does not have a --version flag, so we use its binary's
+		//metadata to detect upgrades instead
+		out, err := exec.Command("pdflatex", "--version").Output()
+		if err != nil {
+			return "", fmt.Errorf("exec pdflatex --version failed: %s", err.Error())
+		}
+		pdf2svgPath, err := exec.LookPath("pdf2svg")
+		if err != nil {
+			return "", err
+		}
+		fi, err := os.Stat(pdf2svgPath)
+		if err != nil {
+			return "", err
+		}
+		version := fmt.Sprintf("%s\n%s %d %d", out, pdf2svgPath, fi.Size(), fi.ModTime().Unix())
+		toolchainHash := md5.Sum([]byte(version))
+		tc.toolchainID = hex.EncodeToString(toolchainHash[:])
+	}
+	return pictureID + "-" + tc.toolchainID + ".svg", nil
+}
@@ -19,8 +19,11 @@
 package main
 
 import (
+	"bytes"
 	"fmt"
 	"html"
+	"html/template"
+	"os"
 	"regexp"
 	"strings"
 
@@ -34,35 +37,45 @@ type TOCEntry struct {
 	Caption     string
 	CaptionHTML string
 	IsPageTitle bool
+	Aliases     []string //additional IDs that lead to this heading, see AddAnchorAliases
+
+	line          int  //in the source file
+	hasExplicitID bool //whether ID was given as "{#id}" in the source file
 }
 
 var sectionNumberRx = regexp.MustCompile(`^((?:\d+\.)+)`)
 var nonWordRx = regexp.MustCompile(`\W+`)
-var headingTagRx = regexp.MustCompile(`<h[1-6]>`)
+var explicitIDRx = regexp.MustCompile(`\s*\{#([\w.:-]+)\}\s*$`)
 var trivialHTMLTagRx = regexp.MustCompile(`</?\w+>`)
 
-// ^ The last two  regexes are ridiculously simple, but catch all the tags
-// generated by the Markdown renderer. We don't need to cover all of HTML
-// here.
+// ^ The last regex is ridiculously simple, but catches all the tags generated
+// by the Markdown renderer. We don't need to cover all of HTML here.
 
 //CollectTableOfContents takes a parsed Markdown document, finds all headings,
 //and builds a table of contents for the top (or sidebar) of the page.
-func CollectTableOfContents(tokens []markdown.Token) (toc []TOCEntry) {
+//
+//Headings can set their ID explicitly with a "{#id}" suffix, which is removed
+//from the tokens. Otherwise, IDs are generated from the heading captions, with
+//suffixes like "-2" where necessary to make them unique within the page.
+func CollectTableOfContents(sourcePath string, tokens []markdown.Token) (toc []TOCEntry) {
 	firstToken := true
 	var current *TOCEntry
 
 	for _, t := range tokens {
 		switch t := t.(type) {
 		case *markdown.HeadingOpen:
-			current = &TOCEntry{Level: t.HLevel - 1}
+			current = &TOCEntry{Level: t.HLevel - 1, line: t.Map[0] + 1}
 			if firstToken {
 				current.IsPageTitle = true
 			}
 
 		case *markdown.HeadingClose:
-			if current.IsPageTitle {
+			switch {
+			case current.hasExplicitID:
+				//ID was already set
+			case current.IsPageTitle:
 				current.ID = "top"
-			} else {
+			default:
 				current.ID = idFromCaption(current.Caption)
 			}
 			toc = append(toc, *current)
@@ -70,6 +83,7 @@ func CollectTableOfContents(tokens []markdown.Token) (toc []TOCEntry) {
 
 		case *markdown.Inline:
 			if current != nil {
+				current.ID, current.hasExplicitID = extractExplicitID(t)
 				current.CaptionHTML = markdown.New(markdown.HTML(true)).RenderTokensToString([]markdown.Token{t})
 				//remove all inline HTML tags, e.g.
 				//before:  <code>vt6/posix1.0</code> - Platform integration on POSIX-compliant systems
@@ -88,9 +102,71 @@ func CollectTableOfContents(tokens []markdown.Token) (toc []TOCEntry) {
 		firstToken = false //in next iteration
 	}
 
+	makeIDsUnique(sourcePath, toc)
 	return
 }
 
+//If the heading text ends in "{#id}", removes that suffix from the token and
+//returns the ID.
+func extractExplicitID(t *markdown.Inline) (string, bool) {
+	match := explicitIDRx.FindStringSubmatch(t.Content)
+	if match == nil || len(t.Children) == 0 {
+		return "", false
+	}
+	//the suffix must be plain text, not e.g. part of a code span
+	last, ok := t.Children[len(t.Children)-1].(*markdown.Text)
+	if !ok || !explicitIDRx.MatchString(last.Content) {
+		return "", false
+	}
+	last.Content = explicitIDRx.ReplaceAllString(last.Content, "")
+	t.Content = explicitIDRx.ReplaceAllString(t.Content, "")
+	return match[1], true
+}
+
+//Ensures that all IDs in the TOC are non-empty and unique. The ID "top" is
+//reserved for the page title since templates and diff pages link to it. Other
+//explicit IDs are reserved next, so that generated IDs never take them away.
+func makeIDsUnique(sourcePath string, toc []TOCEntry) {
+	isUsed := map[string]bool{"top": true}
+	for idx, e := range toc {
+		if e.hasExplicitID {
+			if isUsed[e.ID] {
+				toc[idx].hasExplicitID = false //will be disambiguated below
+			}
+			isUsed[e.ID] = true
+		}
+	}
+
+	for idx := range toc {
+		e := &toc[idx]
+		if e.hasExplicitID || (e.IsPageTitle && e.ID == "top") {
+			continue
+		}
+		id := e.ID
+		if id == "" {
+			id = "heading"
+		}
+		if isUsed[id] {
+			base := id
+			for suffix := 2; isUsed[id]; suffix++ {
+				id = fmt.Sprintf("%s-%d", base, suffix)
+			}
+		}
+		if id != e.ID {
+			switch e.ID {
+			case "":
+				fmt.Fprintf(os.Stderr, "WARNING: %s:%d: cannot derive ID for heading %q, using %q\n", sourcePath, e.line, e.Caption, id)
+			case "top":
+				fmt.Fprintf(os.Stderr, "WARNING: %s:%d: heading ID \"top\" is reserved for the page title, using %q\n", sourcePath, e.line, id)
+			default:
+				fmt.Fprintf(os.Stderr, "WARNING: %s:%d: duplicate heading ID %q, using %q\n", sourcePath, e.line, e.ID, id)
+			}
+			e.ID = id
+		}
+		isUsed[id] = true
+	}
+}
+
 func idFromCaption(text string) string {
 	match := sectionNumberRx.FindStringSubmatch(strings.TrimSpace(text))
 	if match != nil {
@@ -100,53 +176,155 @@ func idFromCaption(text string) string {
 	return strings.ToLower(strings.Trim(nonWordRx.ReplaceAllString(text, "-"), "-"))
 }
 
-//RenderTableOfContents produces the HTML for the table of contents.
-func RenderTableOfContents(toc []TOCEntry) string {
-	text := ""
-	level := 0
+//TOCItem is an entry in the structured table of contents that is given to
+//the page template. Unlike TOCEntry, headings below the current one are
+//nested in Children.
+type TOCItem struct {
+	Level       int //heading level, e.g. 2 for <h2>
+	ID          string
+	Caption     string
+	CaptionHTML template.HTML
+	Children    []*TOCItem
+}
 
+//BuildTableOfContents arranges the headings between <h{minLevel}> and
+//<h{maxLevel}> (inclusive) into a tree. The page title is never included.
+func BuildTableOfContents(toc []TOCEntry, minLevel, maxLevel int) []*TOCItem {
+	var (
+		result []*TOCItem
+		stack  []*TOCItem //the last item on each nesting level
+	)
 	for _, e := range toc {
-		if e.IsPageTitle {
+		level := e.Level + 1
+		if e.IsPageTitle || level < minLevel || level > maxLevel {
 			continue
 		}
-
-		opened := false
-		for level < e.Level {
-			level++
-			text += fmt.Sprintf(`<ul class="h%d"><li>`, level)
-			opened = true
+		item := &TOCItem{
+			Level:       level,
+			ID:          e.ID,
+			Caption:     e.Caption,
+			CaptionHTML: template.HTML(e.CaptionHTML),
 		}
-		for level > e.Level {
-			text += "</li></ul>"
-			level--
+		for len(stack) > 0 && stack[len(stack)-1].Level >= level {
+			stack = stack[:len(stack)-1]
 		}
-		if !opened {
-			text += "</li><li>"
+		if len(stack) == 0 {
+			result = append(result, item)
+		} else {
+			parent := stack[len(stack)-1]
+			parent.Children = append(parent.Children, item)
 		}
+		stack = append(stack, item)
+	}
+	return result
+}
 
-		text += fmt.Sprintf(`<a href="#%s">%s</a>`,
-			e.ID, e.CaptionHTML,
-		)
+//RenderTableOfContents produces the HTML for the table of contents.
+func RenderTableOfContents(items []*TOCItem) string {
+	var buf bytes.Buffer
+	renderTOCItems(&buf, items)
+	return buf.String()
+}
+
+func renderTOCItems(buf *bytes.Buffer, items []*TOCItem) {
+	if len(items) == 0 {
+		return
 	}
-	for level > 0 {
-		text += "</li></ul>"
-		level--
+	//the class is the heading level of the items relative to the page title
+	//(i.e. "h1" for <h2>)
+	fmt.Fprintf(buf, `<ul class="h%d">`, items[0].Level-1)
+	for _, item := range items {
+		fmt.Fprintf(buf, `<li><a href="#%s">%s</a>`, html.EscapeString(item.ID), item.CaptionHTML)
+		renderTOCItems(buf, item.Children)
+		buf.WriteString("</li>")
 	}
+	buf.WriteString("</ul>")
+}
 
-	return text
+//PermalinkOptions controls which permalinks are generated by
+//AddTargetsToHeadings.
+type PermalinkOptions struct {
+	Symbol     string //the link text; empty to disable permalinks
+	Paragraphs bool   //whether paragraphs get IDs and permalinks, too
 }
 
-//InjectTargetsIntoHeadings adds the "id" attributes to all headings, so that
-//they can be navigated to from the TOC.
-func InjectTargetsIntoHeadings(html string, toc []TOCEntry) string {
-	//This is much uglier than I would like since the commonmark renderer is not
-	//extensible in any way, so I have to fix the tags after the fact.
-	idx := -1
-	return headingTagRx.ReplaceAllStringFunc(html, func(tag string) string {
-		idx++
-		return fmt.Sprintf(`%s id="%s">`,
-			strings.TrimSuffix(tag, ">"),
-			toc[idx].ID,
-		)
-	})
+//AddTargetsToHeadings adds the "id" attributes to all headings, so that they
+//can be navigated to from the TOC. The toc must have been obtained from the
+//same tokens by CollectTableOfContents(). Aliases of headings are added as
+//empty elements with the respective ID inside the heading. If enabled in the
+//options, headings (except for the page title) and paragraphs are given a link
+//to themselves (<a class="permalink">), so that readers can copy the link.
+//Paragraph IDs are derived from the ID of the section they are in, e.g.
+//"section-3-2-p4" for the fourth paragraph in section 3.2.
+//
+//The commonmark renderer is not extensible in any way, so this replaces the
+//respective tokens by HTMLBlock tokens containing the desired HTML. Headings
+//and paragraphs written in raw HTML are not touched.
+func AddTargetsToHeadings(sourcePath string, tokens []markdown.Token, toc []TOCEntry, opts PermalinkOptions) ([]markdown.Token, error) {
+	result := make([]markdown.Token, len(tokens))
+	idx := 0
+	var (
+		current        *TOCEntry //the TOC entry for the current heading or section
+		paragraphCount int
+		paragraphID    string //non-empty while inside a paragraph with ID
+	)
+	permalink := func(id string) string {
+		if opts.Symbol == "" {
+			return ""
+		}
+		return fmt.Sprintf(` <a class="permalink" href="#%s">%s</a>`, html.EscapeString(id), html.EscapeString(opts.Symbol))
+	}
+
+	for tokenIdx, t := range tokens {
+		result[tokenIdx] = t
+		switch t := t.(type) {
+		case *markdown.HeadingOpen:
+			if idx >= len(toc) || toc[idx].Level != t.HLevel-1 {
+				return nil, fmt.Errorf("%s:%d: heading does not match table of contents entry #%d", sourcePath, t.Map[0]+1, idx+1)
+			}
+			current = &toc[idx]
+			paragraphCount = 0
+			idx++
+
+			tag := fmt.Sprintf(`<h%d id="%s">`, t.HLevel, html.EscapeString(current.ID))
+			for _, alias := range current.Aliases {
+				tag += fmt.Sprintf(`<span id="%s"></span>`, html.EscapeString(alias))
+			}
+			result[tokenIdx] = &markdown.HTMLBlock{Content: tag, Map: t.Map, Lvl: t.Lvl}
+
+		case *markdown.HeadingClose:
+			if current.IsPageTitle {
+				continue
+			}
+			//the HTMLBlock is not followed by a newline automatically
+			tag := fmt.Sprintf("%s</h%d>\n", permalink(current.ID), t.HLevel)
+			result[tokenIdx] = &markdown.HTMLBlock{Content: tag, Lvl: t.Lvl}
+
+		case *markdown.ParagraphOpen:
+			//hidden paragraphs (in tight lists) do not have a <p> tag to attach the ID to
+			if !opts.Paragraphs || t.Hidden {
+				continue
+			}
+			paragraphCount++
+			sectionID := "top"
+			if current != nil {
+				sectionID = current.ID
+			}
+			paragraphID = fmt.Sprintf("%s-p%d", sectionID, paragraphCount)
+			tag := fmt.Sprintf(`<p id="%s">`, html.EscapeString(paragraphID))
+			result[tokenIdx] = &markdown.HTMLBlock{Content: tag, Map: t.Map, Lvl: t.Lvl}
+
+		case *markdown.ParagraphClose:
+			if paragraphID == "" {
+				continue
+			}
+			tag := permalink(paragraphID) + "</p>\n"
+			result[tokenIdx] = &markdown.HTMLBlock{Content: tag, Lvl: t.Lvl}
+			paragraphID = ""
+		}
+	}
+	if idx != len(toc) {
+		return nil, fmt.Errorf("%s: found %d headings, but table of contents has %d entries", sourcePath, idx, len(toc))
+	}
+	return result, nil
 }
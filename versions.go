@@ -0,0 +1,82 @@
+/*******************************************************************************
+*
+* Copyright 2018 Stefan Majewsky <majewsky@gmx.net>
+*
+* This program is free software: you can redistribute it and/or modify it under
+* the terms of the GNU General Public License as published by the Free Software
+* Foundation, either version 3 of the License, or (at your option) any later
+* version.
+*
+* This program is distributed in the hope that it will be useful, but WITHOUT ANY
+* WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR
+* A PARTICULAR PURPOSE. See the GNU General Public License for more details.
+*
+* You should have received a copy of the GNU General Public License along with
+* this program. If not, see <http://www.gnu.org/licenses/>.
+*
+*******************************************************************************/
+
+package main
+
+import (
+	"path"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+//Matches path elements like "1.0" that identify a version of a module.
+var versionElementRx = regexp.MustCompile(`^\d+(?:\.\d+)*$`)
+
+//Groups all spec pages (i.e. below spec_url_prefix) whose URL path ends in a
+//version number (e.g. "/std/core/1.0") by module (e.g. "/std/core"). The
+//versions of each module are sorted from oldest to newest.
+func versionedModules(pages []*Page, cfg Config) map[string][]*Page {
+	prefix := path.Join("/", cfg.SpecURLPrefix)
+	result := make(map[string][]*Page)
+	for _, page := range pages {
+		if !strings.HasPrefix(page.Path, prefix+"/") {
+			continue
+		}
+		module, version := path.Split(page.Path)
+		if path.Clean(module) == prefix || !versionElementRx.MatchString(version) {
+			continue
+		}
+		module = path.Clean(module)
+		result[module] = append(result[module], page)
+	}
+	for _, versions := range result {
+		sort.SliceStable(versions, func(i, j int) bool {
+			return naturalLess(path.Base(versions[i].Path), path.Base(versions[j].Path))
+		})
+	}
+	return result
+}
+
+//AddVersionLinks finds the latest non-draft version of each module, and sets
+//Page.NewerVersion on all older versions. The result maps the URL path of
+//each module (e.g. "/std/core") to the URL path of its latest version.
+func AddVersionLinks(pages []*Page, root *NavigationTree, cfg Config) map[string]string {
+	result := make(map[string]string)
+	for module, versions := range versionedModules(pages, cfg) {
+		//find latest non-draft version
+		latestIdx := -1
+		for idx, page := range versions {
+			page.NewerVersion = nil
+			if !page.IsDraft {
+				latestIdx = idx
+			}
+		}
+		if latestIdx < 0 {
+			continue
+		}
+		latest := versions[latestIdx]
+		result[module] = latest.Path
+
+		link := ntLocate(root, latest.Path, false).Link()
+		for _, page := range versions[:latestIdx] {
+			page.NewerVersion = &link
+		}
+	}
+	return result
+}
@@ -0,0 +1,94 @@
+/*******************************************************************************
+*
+* Copyright 2018 Stefan Majewsky <majewsky@gmx.net>
+*
+* This program is free software: you can redistribute it and/or modify it under
+* the terms of the GNU General Public License as published by the Free Software
+* Foundation, either version 3 of the License, or (at your option) any later
+* version.
+*
+* This program is distributed in the hope that it will be useful, but WITHOUT ANY
+* WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR
+* A PARTICULAR PURPOSE. See the GNU General Public License for more details.
+*
+* You should have received a copy of the GNU General Public License along with
+* this program. If not, see <http://www.gnu.org/licenses/>.
+*
+*******************************************************************************/
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"time"
+)
+
+//How often Watch() looks for changed files.
+const watchInterval = 500 * time.Millisecond
+
+type fileState struct {
+	ModTime time.Time
+	Size    int64
+}
+
+//Watch looks for changes in the input files of the given Builder and updates
+//the output directory accordingly. After each successful rebuild, the
+//`onRebuild` callback is invoked (if not nil). Watch never returns. Build
+//errors are reported on stderr, then we wait for the next change.
+//
+//We poll the filesystem instead of using inotify and friends: The input
+//directory is small enough that this is cheap, and it works the same everywhere.
+func Watch(b *Builder, onRebuild func()) {
+	state := b.scanInputFiles()
+	for {
+		time.Sleep(watchInterval)
+		newState := b.scanInputFiles()
+		changedPaths := diffFileStates(state, newState)
+		state = newState
+		if len(changedPaths) == 0 {
+			continue
+		}
+
+		fmt.Fprintf(os.Stderr, "rebuilding after %d changed file(s)...\n", len(changedPaths))
+		err := b.Rebuild(changedPaths)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "ERROR: "+err.Error())
+		} else if onRebuild != nil {
+			onRebuild()
+		}
+	}
+}
+
+func (b *Builder) scanInputFiles() map[string]fileState {
+	result := make(map[string]fileState)
+	for _, root := range []string{b.specDir(), b.pagesDir(), b.templateDir(), b.staticDir(), b.redirectsPath()} {
+		//errors are ignored here: if a directory is missing, the next build will
+		//complain about it
+		_ = walk(root, func(path string, fi os.FileInfo) {
+			if fi.Mode().IsRegular() {
+				result[path] = fileState{ModTime: fi.ModTime(), Size: fi.Size()}
+			}
+		})
+	}
+	return result
+}
+
+//Returns all paths that were added, removed or changed between both states.
+func diffFileStates(oldState, newState map[string]fileState) []string {
+	var result []string
+	for path, oldFS := range oldState {
+		newFS, exists := newState[path]
+		if !exists || newFS.Size != oldFS.Size || !newFS.ModTime.Equal(oldFS.ModTime) {
+			result = append(result, path)
+		}
+	}
+	for path := range newState {
+		if _, exists := oldState[path]; !exists {
+			result = append(result, path)
+		}
+	}
+	sort.Strings(result)
+	return result
+}